@@ -0,0 +1,90 @@
+package localcache
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// AdmissionPolicy decides whether an item read from DynamoDB after a cache miss
+// is worth caching, see WithAdmissionPolicy. It must be safe for concurrent use.
+type AdmissionPolicy interface {
+	// Admit is called with the table and cache key of each item that missed,
+	// and reports whether to cache it.
+	Admit(table, key string) bool
+}
+
+// sketchDepth is the number of rows in a recurring miss policy's count-min sketch.
+const sketchDepth = 4
+
+// recurringMisses is the AdmissionPolicy returned by NewRecurringMissPolicy.
+// It counts misses in a count-min sketch, which may overcount (admitting an item early)
+// but never undercounts, and is reset every window.
+type recurringMisses struct {
+	mu     sync.Mutex
+	window time.Duration
+	reset  time.Time
+	mask   uint64
+	rows   [sketchDepth][]uint8
+}
+
+// NewRecurringMissPolicy returns an AdmissionPolicy that only admits an item on its second miss
+// within window, so that items read just once never take up room in the cache.
+// keys is about how many distinct items are expected to miss per window: the policy uses
+// a few bytes per key, and admits more items on their first miss if there are many more.
+// It panics if window isn't positive.
+func NewRecurringMissPolicy(window time.Duration, keys int) AdmissionPolicy {
+	if window <= 0 {
+		panic("localcache: NewRecurringMissPolicy: window must be positive")
+	}
+	width := 1024
+	for width < keys {
+		width *= 2
+	}
+	p := &recurringMisses{
+		window: window,
+		reset:  time.Now(),
+		mask:   uint64(width - 1),
+	}
+	for i := range p.rows {
+		p.rows[i] = make([]uint8, width)
+	}
+	return p
+}
+
+func (p *recurringMisses) Admit(table, key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(table))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// derive each row's index from two halves of the hash (Kirsch-Mitzenmacher)
+	h1, h2 := sum&0xffffffff, sum>>32
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now := time.Now(); now.Sub(p.reset) >= p.window {
+		for _, row := range p.rows {
+			clear(row)
+		}
+		p.reset = now
+	}
+	seen := uint8(255)
+	for i, row := range p.rows {
+		idx := (h1 + uint64(i)*h2) & p.mask
+		if row[idx] < 255 {
+			row[idx]++
+		}
+		seen = min(seen, row[idx])
+	}
+	return seen >= 2
+}
+
+// admit reports whether an item read after a miss should be cached, see WithAdmissionPolicy.
+func (c *Cache) admit(op, table, key string) bool {
+	if c.admission == nil || c.admission.Admit(table, key) {
+		return true
+	}
+	c.log(LogEntry{Op: op, Table: table, Key: key, Msg: "not caching, not admitted"})
+	return false
+}
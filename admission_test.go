@@ -0,0 +1,35 @@
+package localcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecurringMissPolicy(t *testing.T) {
+	p := NewRecurringMissPolicy(time.Hour, 100)
+	if p.Admit("T", "a") {
+		t.Error("admitted on the first miss")
+	}
+	if !p.Admit("T", "a") {
+		t.Error("not admitted on the second miss")
+	}
+	if p.Admit("U", "a") {
+		t.Error("admitted another table's item on its first miss")
+	}
+}
+
+func TestRecurringMissPolicyWindow(t *testing.T) {
+	p := NewRecurringMissPolicy(time.Millisecond, 100)
+	p.Admit("T", "a")
+	time.Sleep(2 * time.Millisecond)
+	if p.Admit("T", "a") {
+		t.Error("admitted on a miss after the window")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("NewRecurringMissPolicy(0, 100) didn't panic")
+		}
+	}()
+	NewRecurringMissPolicy(0, 100)
+}
@@ -0,0 +1,135 @@
+package localcache
+
+import (
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+// Backend is a two-level cache of entries, grouped by primary key and identified by
+// secondary key within the group. The cache keeps items, queries, scans, and so on in
+// separate backends. Backends must be safe for concurrent use.
+//
+// By default, backends are ccache layered caches. Use WithBackend to provide others,
+// such as the one returned by NewLRU.
+type Backend interface {
+	// Get returns the entry, or nil if there isn't one.
+	// It may return expired entries; callers check Expired.
+	Get(primary, secondary string) Entry
+	// Peek is like Get, but doesn't count as a use for the purposes of eviction.
+	Peek(primary, secondary string) Entry
+	Set(primary, secondary string, value interface{}, ttl time.Duration)
+	// Delete removes the entry, reporting whether it was there.
+	Delete(primary, secondary string) bool
+	// DeleteAll removes every entry under primary, reporting whether there were any.
+	DeleteAll(primary string) bool
+	// ItemCount returns the number of entries, which may include expired ones.
+	ItemCount() int
+	Clear()
+	// Stop releases the backend's resources. It won't be used afterwards.
+	Stop()
+}
+
+// Entry is a cached value.
+type Entry interface {
+	Value() interface{}
+	Expired() bool
+	// TTL returns how long until the entry expires, negative if it already has.
+	TTL() time.Duration
+}
+
+// Backend names, as given to the function passed to WithBackend.
+const (
+	BackendItems       = "items"
+	BackendProjections = "projections"
+	BackendQueries     = "queries"
+	BackendScans       = "scans"
+	BackendGSIItems    = "gsi-items"
+)
+
+// ccacheBackend is the default Backend.
+type ccacheBackend struct {
+	lc *ccache.LayeredCache
+}
+
+func newCCacheBackend(cfg *ccache.Configuration) Backend {
+	if cfg == nil {
+		cfg = ccache.Configure()
+	}
+	return ccacheBackend{lc: ccache.Layered(cfg)}
+}
+
+func (b ccacheBackend) Get(primary, secondary string) Entry {
+	item := b.lc.Get(primary, secondary)
+	if item == nil {
+		return nil
+	}
+	return item
+}
+
+// Peek reads from the secondary cache: LayeredCache.Get promotes on every hit,
+// but the secondary cache's Get doesn't. Note that peeking at a primary key that
+// doesn't exist yet leaves an empty bucket behind for it.
+func (b ccacheBackend) Peek(primary, secondary string) Entry {
+	item := b.lc.GetOrCreateSecondaryCache(primary).Get(secondary)
+	if item == nil {
+		return nil
+	}
+	return item
+}
+
+func (b ccacheBackend) Set(primary, secondary string, value interface{}, ttl time.Duration) {
+	b.lc.Set(primary, secondary, value, ttl)
+}
+
+func (b ccacheBackend) Delete(primary, secondary string) bool {
+	return b.lc.Delete(primary, secondary)
+}
+
+func (b ccacheBackend) DeleteAll(primary string) bool {
+	return b.lc.DeleteAll(primary)
+}
+
+func (b ccacheBackend) ItemCount() int {
+	return b.lc.ItemCount()
+}
+
+func (b ccacheBackend) Clear() {
+	b.lc.Clear()
+}
+
+func (b ccacheBackend) Stop() {
+	b.lc.Stop()
+}
+
+// newBackend creates the named backend, using the configured backend function if there is one.
+func (c *Cache) newBackend(name string, cfg *ccache.Configuration) Backend {
+	if c.shards > 1 {
+		return c.newShardedBackend(name, cfg)
+	}
+	return c.newUnshardedBackend(name, cfg)
+}
+
+// tuned returns a copy of cfg with the tuning options applied, or cfg itself if there aren't any.
+func (c *Cache) tuned(cfg *ccache.Configuration) *ccache.Configuration {
+	if len(c.tuning) == 0 {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = ccache.Configure()
+	}
+	cp := *cfg
+	for _, fn := range c.tuning {
+		fn(&cp)
+	}
+	return &cp
+}
+
+func (c *Cache) newUnshardedBackend(name string, cfg *ccache.Configuration) Backend {
+	if c.newBackendFn != nil {
+		if b := c.newBackendFn(name); b != nil {
+			return b
+		}
+	}
+	return newCCacheBackend(cfg)
+}
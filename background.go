@@ -0,0 +1,32 @@
+package localcache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// background runs fn in its own goroutine, tracked so that Flush can wait for it.
+// Errors from background work can't be returned to anyone, so report them with handleError.
+func (c *Cache) background(fn func()) {
+	c.bg.Add(1)
+	go func() {
+		defer c.bg.Done()
+		fn()
+	}()
+}
+
+// Flush waits for in-flight background work to finish, or for ctx to be canceled.
+// Use it before Close to shut down without dropping work,
+// or in tests to wait for background effects.
+func (c *Cache) Flush(ctx aws.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.bg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,7 +1,14 @@
 package localcache
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,57 +21,324 @@ import (
 	// "github.com/davecgh/go-spew/spew"
 )
 
-const cacheTTL = 15 * time.Minute
+// ErrReadOnly is returned by write operations on a Cache created with WithReadOnly.
+var ErrReadOnly = errors.New("localcache: write attempted on read-only cache")
 
-func New(p client.ConfigProvider, cfgs ...*aws.Config) dynamodbiface.DynamoDBAPI {
+// defaultTTL is how long entries are cached unless configured otherwise.
+// Query and scan results default to the item TTL, see WithItemTTL.
+const defaultTTL = 15 * time.Minute
+
+// New creates a new DynamoDB client with a cache in front of it.
+// To configure the cache with options, use NewWithDB.
+func New(p client.ConfigProvider, cfgs ...*aws.Config) *Cache {
 	db := dynamodb.New(p, cfgs...)
 	return NewWithDB(db)
 }
 
-func NewWithDB(client *dynamodb.DynamoDB) dynamodbiface.DynamoDBAPI {
-	return &Cache{
+// NewWithDB wraps the given DynamoDB client with a cache.
+// The result satisfies dynamodbiface.DynamoDBAPI, so it can be used in place of the client.
+func NewWithDB(client *dynamodb.DynamoDB, opts ...Option) *Cache {
+	c := &Cache{
 		DynamoDB: client,
 
-		items:     ccache.New(ccache.Configure()),
-		tableDesc: ccache.New(ccache.Configure()),
-		queries:   ccache.Layered(ccache.Configure()),
-		scans:     ccache.Layered(ccache.Configure()),
+		itemConfig:  ccache.Configure(),
+		queryConfig: ccache.Configure(),
+		scanConfig:  ccache.Configure(),
+		descConfig:  ccache.Configure(),
 
 		allowedTables: map[string]struct{}{},
+		deniedTables:  map[string]struct{}{},
+
+		itemTTL:  new(atomic.Int64),
+		queryTTL: new(atomic.Int64),
+		scanTTL:  new(atomic.Int64),
+
+		enabled: new(atomic.Bool),
+		done:    make(chan struct{}),
+		errlog:  new(errorLog),
 
-		hits: new(atomic.Uint64),
-		miss: new(atomic.Uint64),
+		stats: new(counters),
+
+		gens:  new(generations),
+		sizes: new(cacheSizes),
+	}
+	c.enabled.Store(true)
+	c.itemTTL.Store(int64(defaultTTL))
+	c.descTTL = defaultDescTTL
+	c.staleGrace = defaultStaleGrace
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.queryTTL.Load() == 0 {
+		c.queryTTL.Store(c.itemTTL.Load())
+	}
+	if c.scanTTL.Load() == 0 {
+		c.scanTTL.Store(c.itemTTL.Load())
+	}
+	itemConfig := c.tuned(c.itemConfig)
+	c.items = c.newBackend(BackendItems, itemConfig)
+	c.projections = c.newBackend(BackendProjections, itemConfig)
+	if c.tableDesc == nil {
+		c.tableDesc = NewDescCache(c.descConfig)
+		c.ownDesc = true
+	}
+	queryConfig := c.tuned(c.queryConfig)
+	if c.querySize > 0 {
+		cfg := *queryConfig
+		queryConfig = cfg.MaxSize(c.querySize)
+	}
+	c.queries = c.newBackend(BackendQueries, queryConfig)
+	c.scans = c.newBackend(BackendScans, c.tuned(c.scanConfig))
+	if c.gsiItemCache {
+		c.gsiItems = c.newBackend(BackendGSIItems, c.tuned(c.queryConfig))
 	}
+	if c.pressure != nil {
+		go c.watchPressure(int64(c.items.ItemCount()))
+	}
+	if c.statsFn != nil && c.statsInterval > 0 {
+		go c.reportStats()
+	}
+	if len(c.warmTables) > 0 {
+		c.background(func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				select {
+				case <-c.done:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			if err := c.Warmup(ctx, c.warmTables...); err != nil {
+				c.handleError(err)
+			}
+		})
+	}
+	return c
 }
 
 type Cache struct {
 	*dynamodb.DynamoDB
 
-	items     *ccache.Cache
-	tableDesc *ccache.Cache
-	queries   *ccache.LayeredCache
-	scans     *ccache.LayeredCache
-
+	items     Backend
+	tableDesc *DescCache
+	ownDesc   bool
+	queries   Backend
+	scans     Backend
+	gsiItems  Backend
+
+	projections Backend
+
+	newBackendFn func(name string) Backend
+	newShardFn   func(name string, shard int) Backend
+	shards       int
+	sharder      func(key string) int
+	warmTables   []string
+	policy       func(ctx aws.Context, op, table string) Decision
+	querySize    int64
+	scanLimit    *scanLimit
+	queryTTLFunc func(*dynamodb.QueryInput) time.Duration
+	admission    AdmissionPolicy
+	transformFn  func(table string, item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue
+
+	// prefetch consistency overrides, see WithPrefetchConsistency
+	prefetchConsistency map[string]bool
+	prefetchEventual    bool
+
+	itemConfig  *ccache.Configuration
+	queryConfig *ccache.Configuration
+	scanConfig  *ccache.Configuration
+	descConfig  *ccache.Configuration
+	// ccache tuning applied to each of the above but descConfig, see WithItemsToPrune and friends
+	tuning []func(*ccache.Configuration)
+
+	tablesMu      sync.RWMutex
 	allowedTables map[string]struct{}
+	deniedTables  map[string]struct{}
+	// table → indexes whose queries are cached, for tables limited by WithInvalidatedIndexes
+	cachedIndexes  map[string]map[string]struct{}
+	maxKeyLen      int
+	maxItemBytes   int
+	ttlAttr        string
+	softDeleteAttr string
+
+	descTTL time.Duration
+
+	negativeTTL    time.Duration
+	serveStale     bool
+	staleGrace     time.Duration
+	emptyResultTTL time.Duration
+	jitter         float64
+	negativeJitter float64
+
+	skipLimitedFilterScans bool
+	gsiItemCache           bool
+	indexScopedScans       bool
+	localProjection        bool
+	batchPutPrefetch       bool
+	noInputMutation        bool
+	keyTiming              bool
+	dryRun                 bool
+	readOnly               bool
+
+	logger    Logger
+	traceHook TraceHook
+	onError   func(error)
+	publisher *invalidationPublisher
+	errlog    *errorLog
+	pressure  *pressureWatcher
+
+	statsInterval time.Duration
+	statsFn       func(Stats)
+
+	done      chan struct{}
+	closeOnce sync.Once
+	bg        sync.WaitGroup
+
+	itemTTL  *atomic.Int64
+	queryTTL *atomic.Int64
+	scanTTL  *atomic.Int64
 
 	Debug bool
 
-	hits *atomic.Uint64
-	miss *atomic.Uint64
+	enabled *atomic.Bool
+
+	stats *counters
+
+	gens  *generations
+	sizes *cacheSizes
+	// table → *atomic.Uint64, see invalidateTable
+	epochs sync.Map
+	// table → *atomic.Uint64, see dropItems
+	itemEpochs sync.Map
 }
 
+// Close stops the cache's background goroutines.
+// The cache must not be used after it is closed.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.items.Stop()
+		c.projections.Stop()
+		if c.ownDesc {
+			c.tableDesc.Close()
+		}
+		c.queries.Stop()
+		c.scans.Stop()
+		if c.gsiItems != nil {
+			c.gsiItems.Stop()
+		}
+	})
+	return nil
+}
+
+// PurgeAll removes everything from the cache.
+// A description cache shared with WithSharedDescCache is left alone.
 func (c *Cache) PurgeAll() {
 	c.items.Clear()
-	c.tableDesc.Clear()
+	c.projections.Clear()
+	if c.ownDesc {
+		c.tableDesc.Clear()
+	}
 	c.queries.Clear()
 	c.scans.Clear()
+	c.scanLimit.clear()
+	if c.gsiItems != nil {
+		c.gsiItems.Clear()
+	}
+}
+
+// InvalidateIndexPartition drops cached queries against the given index
+// partition, for when you know some item with that index hash key changed
+// but don't have the full item (such as from a stream record).
+// For indexes with only a hash key, all cached queries against the index are dropped.
+func (c *Cache) InvalidateIndexPartition(table, indexName string, hashKey *dynamodb.AttributeValue) error {
+	schema, err := c.schemaOfIndex(aws.BackgroundContext(), table, indexName)
+	if err != nil {
+		return err
+	}
+	key := c.queryPartition(table, indexName, schema, hashKey)
+	c.log(LogEntry{Op: "InvalidateIndexPartition", Table: table, Key: key, Msg: "invalidate"})
+	c.deleteQueries(key)
+	return nil
+}
+
+// Uncached returns the underlying DynamoDB client, for calls that must bypass the cache.
+// Writes made through it don't invalidate the cache.
+func (c *Cache) Uncached() dynamodbiface.DynamoDBAPI {
+	return c.DynamoDB
 }
 
+// SetEnabled turns caching on or off. While disabled, every method passes
+// straight through to DynamoDB without reading, writing, or invalidating
+// the cache. Caching is enabled by default.
+//
+// Entries cached before disabling are not purged, and writes made while disabled
+// won't invalidate them. Call PurgeAll when re-enabling if that matters.
+func (c *Cache) SetEnabled(enabled bool) {
+	c.enabled.Store(enabled)
+}
+
+// Enabled reports whether caching is enabled. See SetEnabled.
+func (c *Cache) Enabled() bool {
+	return c.enabled.Load()
+}
+
+// SetItemTTL changes how long newly cached items live.
+// Entries that are already cached keep the TTL they were stored with.
+func (c *Cache) SetItemTTL(ttl time.Duration) {
+	c.itemTTL.Store(int64(ttl))
+}
+
+// SetQueryTTL changes how long newly cached query results live.
+// Entries that are already cached keep the TTL they were stored with.
+func (c *Cache) SetQueryTTL(ttl time.Duration) {
+	c.queryTTL.Store(int64(ttl))
+}
+
+// SetScanTTL changes how long newly cached scan results live.
+// Entries that are already cached keep the TTL they were stored with.
+func (c *Cache) SetScanTTL(ttl time.Duration) {
+	c.scanTTL.Store(int64(ttl))
+}
+
+// Allow adds table to the allow list. Once any table is allowed, only allowed tables are cached;
+// until then, every table is. Tables on the deny list are never cached, see WithDenyList.
 func (c *Cache) Allow(table string) {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
 	c.allowedTables[table] = struct{}{}
 }
 
+// Deny adds table to the deny list, see WithDenyList.
+func (c *Cache) Deny(table string) {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	c.deniedTables[table] = struct{}{}
+}
+
+// AllowedTables returns the tables on the allow list, sorted.
+// It returns nil if every table is allowed, see Allow.
+func (c *Cache) AllowedTables() []string {
+	c.tablesMu.RLock()
+	defer c.tablesMu.RUnlock()
+	if len(c.allowedTables) == 0 {
+		return nil
+	}
+	tables := make([]string, 0, len(c.allowedTables))
+	for table := range c.allowedTables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
 func (c *Cache) isAllowed(table string) bool {
+	c.tablesMu.RLock()
+	defer c.tablesMu.RUnlock()
+	if _, denied := c.deniedTables[table]; denied {
+		return false
+	}
 	if len(c.allowedTables) == 0 {
 		return true
 	}
@@ -72,14 +346,10 @@ func (c *Cache) isAllowed(table string) bool {
 	return ok
 }
 
-func (c *Cache) warmup() {
-	// c.DynamoDB.ListTablesPages(input, fn)
-}
-
 var none = &struct{}{}
 
-func (c *Cache) getItem(key string) (interface{}, bool) {
-	item := c.items.Get(key)
+func (c *Cache) getItem(table, key string) (interface{}, bool) {
+	item := c.items.Get(c.cacheKey(table), c.cacheKey(key))
 	if item == nil {
 		return nil, false
 	}
@@ -90,227 +360,632 @@ func (c *Cache) getItem(key string) (interface{}, bool) {
 	return v, true
 }
 
-func (c *Cache) setItem(key string, v interface{}) {
-	c.items.Set(key, v, cacheTTL)
+// itemOp is an operation that caches whole items.
+// Query and Scan results may be projected, by the request or by an index (KEYS_ONLY or INCLUDE),
+// or read from an index that lags behind the table, so they never stand in for whole items.
+// There is deliberately no itemOp for them, so they can't be passed to setItem or fillItem.
+// GSI items have a cache of their own, see WithGSIItemCache.
+type itemOp struct{ name string }
+
+var (
+	opGetItem            = itemOp{"GetItem"}
+	opBatchGetItem       = itemOp{"BatchGetItem"}
+	opPutItem            = itemOp{"PutItem"}
+	opUpdateItem         = itemOp{"UpdateItem"}
+	opDeleteItem         = itemOp{"DeleteItem"}
+	opBatchWriteItem     = itemOp{"BatchWriteItem"}
+	opTransactWriteItems = itemOp{"TransactWriteItems"}
+	opWarmItems          = itemOp{"WarmItems"}
+	opRefreshItem        = itemOp{"RefreshItem"}
+)
+
+// setItem caches v as the current version of an item, after writing it.
+// Reads caching what they found use fillItem instead, see generations.
+func (c *Cache) setItem(ctx aws.Context, op itemOp, table, key string, v interface{}) {
+	s := c.gens.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	c.storeItem(ctx, op, table, key, v)
+}
+
+func (c *Cache) storeItem(ctx aws.Context, op itemOp, table, key string, v interface{}) {
+	ttl, ok := c.ttlOf(ctx, v)
+	if !ok {
+		c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: "not caching item"})
+		c.removeItem(table, key)
+		return
+	}
+	if item, ok := v.(map[string]*dynamodb.AttributeValue); ok && c.maxItemBytes > 0 {
+		if size := itemSize(item); size > c.maxItemBytes {
+			c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: "not caching large item", Args: []interface{}{size, "bytes"}})
+			c.removeItem(table, key)
+			return
+		}
+	}
+	if v, ok = c.transform(table, v); !ok {
+		c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: "not caching, skipped by transform"})
+		c.removeItem(table, key)
+		return
+	}
+	msg := "caching"
+	if v == none {
+		msg = "caching empty"
+	}
+	c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: msg, TTL: ttl})
+	c.trackInsert(table, c.cacheKey(key))
+	c.items.Set(c.cacheKey(table), c.cacheKey(key), v, ttl)
+	c.sizes.items.add(key, v)
+	c.deleteProjections(table, key)
+}
+
+// transform applies the cache transform to an item about to be cached, see WithCacheTransform.
+// It returns false if the item shouldn't be cached.
+func (c *Cache) transform(table string, v interface{}) (interface{}, bool) {
+	item, ok := v.(map[string]*dynamodb.AttributeValue)
+	if c.transformFn == nil || !ok {
+		return v, true
+	}
+	item = c.transformFn(table, item)
+	return item, item != nil
+}
+
+// jitter randomly shortens ttl by up to the given fraction of it,
+// so entries cached at the same time don't all expire at once.
+func jitter(ttl time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(frac*rand.Float64()*float64(ttl))
 }
 
-func (c *Cache) deleteItem(key string) {
-	c.items.Delete(key)
+// ttlOf returns how long an item may be cached: the item TTL (or the one set on ctx by WithTTL),
+// or less if the item expires sooner according to its TTL attribute (see WithItemTTLAttribute).
+// The item's own expiry never extends the TTL past the configured one,
+// because the cache can't see writes made elsewhere in the meantime.
+// It returns false if the item has already expired, or WithTTL says not to cache it.
+func (c *Cache) ttlOf(ctx aws.Context, v interface{}) (time.Duration, bool) {
+	override, overridden := ttlFrom(ctx)
+	if overridden && override <= 0 {
+		return 0, false
+	}
+	if v == none || c.softDeleted(v) {
+		if overridden {
+			return override, true
+		}
+		ttl := c.negativeTTL
+		if ttl == 0 {
+			ttl = time.Duration(c.itemTTL.Load())
+		}
+		return jitter(ttl, c.negativeJitter), true
+	}
+	ttl := jitter(time.Duration(c.itemTTL.Load()), c.jitter)
+	if overridden {
+		ttl = override
+	}
+	if c.ttlAttr == "" {
+		return ttl, true
+	}
+	item, ok := v.(map[string]*dynamodb.AttributeValue)
+	if !ok {
+		return ttl, true
+	}
+	av := item[c.ttlAttr]
+	if av == nil || av.N == nil {
+		return ttl, true
+	}
+	epoch, err := strconv.ParseInt(*av.N, 10, 64)
+	if err != nil {
+		return ttl, true
+	}
+	left := time.Until(time.Unix(epoch, 0))
+	if left <= 0 {
+		return 0, false
+	}
+	return min(ttl, left), true
+}
+
+// deleteItem drops an item, after writing it.
+func (c *Cache) deleteItem(table, key string) {
+	s := c.gens.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	c.removeItem(table, key)
+}
+
+func (c *Cache) removeItem(table, key string) {
+	c.trackDelete(c.items.Delete(c.cacheKey(table), c.cacheKey(key)))
+	c.deleteProjections(table, key)
 }
 
 func (c *Cache) getQuery(table, key string) (interface{}, bool) {
-	item := c.queries.Get(table, key)
-	if item == nil {
+	item := c.queries.Get(c.cacheKey(table), c.cacheKey(key))
+	if item == nil || item.Expired() {
 		return nil, false
 	}
 	return item.Value(), true
 }
 
-func (c *Cache) setQuery(table, key string, v interface{}) {
-	c.queries.Set(table, key, v, 5*time.Minute)
+func (c *Cache) deleteQuery(table, key string) {
+	c.queries.Delete(c.cacheKey(table), c.cacheKey(key))
+}
+
+func (c *Cache) setQuery(table, key string, input *dynamodb.QueryInput, out *dynamodb.QueryOutput) {
+	ttl := time.Duration(c.queryTTL.Load())
+	if len(out.Items) == 0 && c.emptyResultTTL > 0 {
+		ttl = c.emptyResultTTL
+	}
+	if c.queryTTLFunc != nil {
+		switch d := c.queryTTLFunc(input); {
+		case d == DontCache:
+			c.log(LogEntry{Op: "Query", Table: *input.TableName, Key: key, Msg: "not caching query", Args: []interface{}{table}})
+			return
+		case d > 0:
+			ttl = d
+		}
+	}
+	c.log(LogEntry{Op: "Query", Table: *input.TableName, Key: key, Msg: "caching", TTL: ttl, Args: []interface{}{table}})
+	c.queries.Set(c.cacheKey(table), c.cacheKey(key), out, ttl)
+	c.sizes.queries.add(key, out)
+}
+
+// scanLayer returns the scan cache layer for input: the table,
+// or with WithIndexScopedScanCache, the index if it scans one.
+func (c *Cache) scanLayer(input *dynamodb.ScanInput) string {
+	if c.indexScopedScans && input.IndexName != nil {
+		return tableHashKey(*input.TableName, nil, *input.IndexName)
+	}
+	return *input.TableName
+}
+
+func (c *Cache) deleteScan(table, key string) {
+	c.scans.Delete(c.cacheKey(table), c.cacheKey(key))
+	c.scanLimit.remove(table, key)
 }
 
 func (c *Cache) getScan(table, key string) (interface{}, bool) {
-	item := c.scans.Get(table, key)
-	if item == nil {
+	item := c.scans.Get(c.cacheKey(table), c.cacheKey(key))
+	if item == nil || item.Expired() {
 		return nil, false
 	}
+	c.scanLimit.hit(table, key)
 	return item.Value(), true
 }
 
-func (c *Cache) setScan(table, key string, v interface{}) {
-	c.scans.Set(table, key, v, 5*time.Minute)
+func (c *Cache) setScan(table, key string, out *dynamodb.ScanOutput) {
+	ttl := time.Duration(c.scanTTL.Load())
+	if len(out.Items) == 0 && c.emptyResultTTL > 0 {
+		ttl = c.emptyResultTTL
+	}
+	c.log(LogEntry{Op: "Scan", Table: table, Key: key, Msg: "caching", TTL: ttl})
+	c.scans.Set(c.cacheKey(table), c.cacheKey(key), out, ttl)
+	c.sizes.scans.add(key, out)
+	c.trackScan(table, key)
 }
 
-func (c *Cache) invalidate(table string, item map[string]*dynamodb.AttributeValue) {
-	desc, err := c.desc(table)
-	if err != nil {
-		panic(err)
-	}
-	c.scans.DeleteAll(table)
-	if len(desc.Table.KeySchema) == 1 {
-		c.queries.DeleteAll(table)
-	} else {
-		key := tableHashKey(table, (item[*desc.Table.KeySchema[0].AttributeName]), "")
-		c.log("invalidate", key)
-		c.queries.DeleteAll(key)
+func (c *Cache) deleteQueries(partition string) {
+	c.queries.DeleteAll(c.cacheKey(partition))
+}
+
+// peek reads an entry without promoting it in the LRU, so diagnostic reads
+// don't skew eviction order.
+func peek(b Backend, primary, secondary string) (interface{}, bool) {
+	item := b.Peek(primary, secondary)
+	if item == nil || item.Expired() {
+		return nil, false
 	}
-	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
-		if len(gsi.KeySchema) == 1 {
-			key := tableHashKey(table, nil, *gsi.IndexName)
-			c.log("invalidate", key)
-			c.queries.DeleteAll(key)
-		} else if hk, ok := item[*gsi.KeySchema[0].AttributeName]; ok {
-			key := tableHashKey(table, (hk), *gsi.IndexName)
-			c.log("invalidate", key)
-			c.queries.DeleteAll(key)
-		}
+	return item.Value(), true
+}
+
+func (c *Cache) peekItem(table, key string) (interface{}, bool) {
+	return peek(c.items, c.cacheKey(table), c.cacheKey(key))
+}
+
+// ItemTTL returns how long the given item will stay cached, and whether it's cached at all.
+// Items cached as not existing count as cached.
+func (c *Cache) ItemTTL(table string, key map[string]*dynamodb.AttributeValue) (time.Duration, bool) {
+	schema, err := c.schemaOf(aws.BackgroundContext(), table)
+	if err != nil {
+		return 0, false
 	}
-	for _, lsi := range desc.Table.LocalSecondaryIndexes {
-		if hk, ok := item[*lsi.KeySchema[0].AttributeName]; ok {
-			key := tableHashKey(table, (hk), *lsi.IndexName)
-			c.log("invalidate", key)
-			c.queries.DeleteAll(key)
-		}
+	entry := c.items.Peek(c.cacheKey(table), c.cacheKey(itemKey(table, key, schema)))
+	if entry == nil || entry.Expired() {
+		return 0, false
 	}
+	return entry.TTL(), true
 }
 
-func (c *Cache) invalidateRough(table string, item map[string]*dynamodb.AttributeValue) {
-	c.invalidate(table, item)
+func (c *Cache) invalidate(ctx aws.Context, table string, item map[string]*dynamodb.AttributeValue, opts ...request.Option) {
+	inv := c.newInvalidation(ctx, opts...)
+	inv.add(table, item)
+	inv.run()
 }
 
 var emptyGet = &dynamodb.GetItemOutput{}
 
 func (c *Cache) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
+		return c.DynamoDB.GetItemWithContext(ctx, input, opts...)
+	}
+	decision := c.decide(ctx, "GetItem", *input.TableName)
+	if decision == Bypass {
 		return c.DynamoDB.GetItemWithContext(ctx, input, opts...)
 	}
 
 	// spew.Dump(input)
-	schema, err := c.schemaOf(*input.TableName)
+	schema, err := c.schemaOf(ctx, *input.TableName, opts...)
 	if err != nil {
-		return nil, err
+		c.degrade(err)
+		return c.DynamoDB.GetItemWithContext(ctx, input, opts...)
 	}
+	kstart := c.keyStart()
 	key := itemKey(*input.TableName, input.Key, schema)
-	if item, ok := c.getItem(key); ok {
-		c.incHit()
-		if item == none {
-			c.log("returning empty cached", key)
+	c.timeKey(kstart)
+
+	snap := snapshotFrom(ctx)
+	if decision == Refresh {
+		c.deleteItem(*input.TableName, key)
+		snap.forget(key)
+	}
+	var proj string
+	if isProjected(input.ProjectionExpression, input.AttributesToGet) {
+		proj = projectionKey(input.ProjectionExpression, input.AttributesToGet, input.ExpressionAttributeNames)
+	}
+	if out, ok := snap.get(key, proj); ok && !c.dryRun {
+		c.log(LogEntry{Op: "GetItem", Table: *input.TableName, Key: key, Msg: "returning snapshot", Args: []interface{}{proj}})
+		return out, nil
+	}
+	var out *dynamodb.GetItemOutput
+	if proj != "" {
+		out, err = c.getProjectedItem(ctx, input, key, proj, opts...)
+	} else {
+		out, err = c.getFullItem(ctx, input, key, opts...)
+	}
+	if err == nil {
+		snap.set(key, proj, out)
+	}
+	return out, err
+}
+
+func (c *Cache) getFullItem(ctx aws.Context, input *dynamodb.GetItemInput, key string, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	item, ok := c.getItem(*input.TableName, key)
+	if c.lookup(ctx, ok, LogEntry{Op: "GetItem", Table: *input.TableName, Key: key}) {
+		if item == none || c.softDeleted(item) {
 			return emptyGet, nil
 		}
-		c.log("returning cached", key)
 		return &dynamodb.GetItemOutput{
 			Item: item.(map[string]*dynamodb.AttributeValue),
 		}, nil
 	}
-	c.incMiss()
+	gen := c.itemGen(*input.TableName, key)
+	start := time.Now()
 	out, err := c.DynamoDB.GetItemWithContext(ctx, input, opts...)
+	c.timeBackend(start)
 	if err != nil {
+		c.recordError(*input.TableName, err)
+		if stale, ok := c.staleGet(*input.TableName, key, "", err); ok {
+			return stale, nil
+		}
 		return out, err
 	}
-	c.log("caching", key)
-	c.setItem(key, out.Item)
+	switch {
+	case ok:
+		// in a dry run, ok means the lookup would have hit, so the cached item stays as it was
+	case !c.admit("GetItem", *input.TableName, key):
+	case out.Item == nil:
+		c.fillItem(ctx, opGetItem, *input.TableName, key, none, gen)
+	default:
+		c.fillItem(ctx, opGetItem, *input.TableName, key, out.Item, gen)
+	}
+	if c.softDeleted(out.Item) {
+		return &dynamodb.GetItemOutput{ConsumedCapacity: out.ConsumedCapacity}, err
+	}
 	return out, err
 }
 
 func (c *Cache) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
 		return c.DynamoDB.PutItemWithContext(ctx, input, opts...)
 	}
 
-	schema, err := c.schemaOf(*input.TableName)
+	schema, err := c.schemaOf(ctx, *input.TableName, opts...)
 	if err != nil {
 		return nil, err
 	}
 	key := itemKey(*input.TableName, input.Item, schema)
 
+	// the overwritten item's global index partitions may differ from the new one's,
+	// as may the indexes it's in, whose scans are cached separately with WithIndexScopedScanCache
+	desc, err := c.desc(ctx, *input.TableName, opts...)
+	needsOld := err == nil && (len(desc.Table.GlobalSecondaryIndexes) > 0 ||
+		c.indexScopedScans && len(desc.Table.LocalSecondaryIndexes) > 0)
+	prefetch := c.newPrefetcher(ctx, "PutItem", opts...)
+	if needsOld {
+		if c.noInputMutation {
+			// find out what's being overwritten ourselves, see WithNoInputMutation
+			prefetch.add(*input.TableName, keyOf(input.Item, schema))
+			if err := prefetch.run(); err != nil {
+				return nil, err
+			}
+		} else if input.ReturnValues == nil || *input.ReturnValues == dynamodb.ReturnValueNone {
+			input.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+		}
+	}
+
 	out, err := c.DynamoDB.PutItemWithContext(ctx, input, opts...)
 	if err != nil {
+		c.recordError(*input.TableName, err)
 		return out, err
 	}
-	c.log("caching put", key)
-	c.setItem(key, input.Item)
-	c.invalidate(*input.TableName, input.Item)
+	old, known := c.peekItem(*input.TableName, key)
+	c.setItem(ctx, opPutItem, *input.TableName, key, input.Item)
+	snapshotFrom(ctx).forget(key)
+	inv := c.newInvalidation(ctx, opts...)
+	inv.add(*input.TableName, input.Item)
+	if needsOld {
+		switch {
+		case len(out.Attributes) > 0:
+			inv.add(*input.TableName, out.Attributes)
+		case known && old != none:
+			inv.add(*input.TableName, old.(map[string]*dynamodb.AttributeValue))
+		}
+		prefetch.invalidate(inv)
+	}
+	inv.run()
 	return out, err
 }
 
 func (c *Cache) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
 		return c.DynamoDB.DeleteItemWithContext(ctx, input, opts...)
 	}
 
-	schema, err := c.schemaOf(*input.TableName)
+	schema, err := c.schemaOf(ctx, *input.TableName, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	input.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+	prefetch := c.newPrefetcher(ctx, "DeleteItem", opts...)
+	if c.noInputMutation {
+		// find out what's being deleted ourselves, see WithNoInputMutation
+		prefetch.add(*input.TableName, input.Key)
+		if err := prefetch.run(); err != nil {
+			return nil, err
+		}
+	} else {
+		input.ReturnValues = aws.String(dynamodb.ReturnValueAllOld)
+	}
 
 	out, err := c.DynamoDB.DeleteItemWithContext(ctx, input, opts...)
 	if err != nil {
+		c.recordError(*input.TableName, err)
 		return out, err
 	}
 
 	key := itemKey(*input.TableName, input.Key, schema)
-	c.setItem(key, none)
-	c.invalidate(*input.TableName, out.Attributes)
-	c.log("deleting cached", key)
-
+	old, known := c.peekItem(*input.TableName, key)
+	c.setItem(ctx, opDeleteItem, *input.TableName, key, none)
+	snapshotFrom(ctx).forget(key)
+	inv := c.newInvalidation(ctx, opts...)
+	inv.add(*input.TableName, input.Key)
+	switch {
+	case len(out.Attributes) > 0:
+		inv.add(*input.TableName, out.Attributes)
+	case known && old != none:
+		inv.add(*input.TableName, old.(map[string]*dynamodb.AttributeValue))
+	case prefetch.item(*input.TableName, input.Key, schema) != nil:
+		// added by prefetch.invalidate below
+	default:
+		// there's no old item to go on: DynamoDB returns none when the item wasn't there,
+		// but also when it couldn't (such as for lack of permission to read it),
+		// so there's no telling which index partitions it was in
+		c.invalidateTable(ctx, *input.TableName, opts...)
+	}
+	prefetch.invalidate(inv)
+	inv.run()
 	return out, err
 }
 
 func (c *Cache) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
 		return c.DynamoDB.UpdateItemWithContext(ctx, input, opts...)
 	}
 
-	schema, err := c.schemaOf(*input.TableName)
+	schema, err := c.schemaOf(ctx, *input.TableName, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	// TODO: undo this later maybe
-	if input.ReturnValues == nil || *input.ReturnValues == dynamodb.ReturnValueNone {
+	if !c.noInputMutation && (input.ReturnValues == nil || *input.ReturnValues == dynamodb.ReturnValueNone) {
 		input.ReturnValues = aws.String(dynamodb.ReturnValueAllNew)
 	}
 
-	if input.ReturnValues == nil || *input.ReturnValues != dynamodb.ReturnValueAllNew {
-		prefetch := c.newPrefetcher()
-		prefetch.add(*input.TableName, input.Key)
-		if err := prefetch.run(ctx, opts...); err != nil {
-			return nil, err
+	desc, err := c.desc(ctx, *input.TableName, opts...)
+	movesIndexKey := err == nil && updatesIndexKey(desc, input)
+
+	prefetch := c.newPrefetcher(ctx, "UpdateItem", opts...)
+	mode := aws.StringValue(input.ReturnValues)
+	switch mode {
+	case dynamodb.ReturnValueAllNew:
+		if movesIndexKey {
+			// the new item doesn't say which index partitions it left
+			prefetch.add(*input.TableName, input.Key)
 		}
+	case dynamodb.ReturnValueAllOld:
+		// DynamoDB tells us what the item was
+	default:
+		prefetch.add(*input.TableName, input.Key)
+	}
+	if err := prefetch.run(); err != nil {
+		return nil, err
 	}
 
 	out, err := c.DynamoDB.UpdateItemWithContext(ctx, input, opts...)
 	if err != nil {
+		c.recordError(*input.TableName, err)
 		return out, err
 	}
 
 	key := itemKey(*input.TableName, input.Key, schema)
-	if input.ReturnValues != nil && *input.ReturnValues == dynamodb.ReturnValueAllNew {
-		c.log("cache updated", key)
-		c.setItem(key, out.Attributes)
-		c.invalidate(*input.TableName, out.Attributes)
-	} else {
-		c.log("delete updated", key)
-		c.deleteItem(key)
-		c.invalidateRough(*input.TableName, input.Key)
+	snapshotFrom(ctx).forget(key)
+	inv := c.newInvalidation(ctx, opts...)
+	switch mode {
+	case dynamodb.ReturnValueAllNew:
+		c.setItem(ctx, opUpdateItem, *input.TableName, key, out.Attributes)
+		inv.add(*input.TableName, out.Attributes)
+	case dynamodb.ReturnValueAllOld:
+		c.log(LogEntry{Op: "UpdateItem", Table: *input.TableName, Key: key, Msg: "deleting"})
+		c.deleteItem(*input.TableName, key)
+		inv.add(*input.TableName, input.Key)
+		if len(out.Attributes) > 0 {
+			inv.add(*input.TableName, out.Attributes)
+		}
+		if movesIndexKey {
+			// the old item doesn't say which index partitions it joined
+			c.invalidateTable(ctx, *input.TableName, opts...)
+		}
+	case dynamodb.ReturnValueUpdatedNew, dynamodb.ReturnValueUpdatedOld:
+		c.log(LogEntry{Op: "UpdateItem", Table: *input.TableName, Key: key, Msg: "deleting"})
+		c.deleteItem(*input.TableName, key)
+		inv.add(*input.TableName, input.Key)
+		// the updated attributes over the item as it was give its new index partitions (UPDATED_NEW),
+		// or correct the prefetched item if it was out of date (UPDATED_OLD).
+		// Removed attributes aren't returned, but then the item simply left a partition we already have.
+		inv.add(*input.TableName, overlay(prefetch.item(*input.TableName, input.Key, schema), input.Key, out.Attributes))
+		if mode == dynamodb.ReturnValueUpdatedOld && movesIndexKey {
+			// the old attributes don't say which index partitions it joined
+			c.invalidateTable(ctx, *input.TableName, opts...)
+		}
+	default:
+		c.log(LogEntry{Op: "UpdateItem", Table: *input.TableName, Key: key, Msg: "deleting"})
+		c.deleteItem(*input.TableName, key)
+		inv.add(*input.TableName, input.Key)
+		if movesIndexKey {
+			// the prefetched item doesn't say which index partitions it joined
+			c.invalidateTable(ctx, *input.TableName, opts...)
+		}
 	}
+	prefetch.invalidate(inv)
+	inv.run()
 	return out, err
 }
 
+// overlay returns a copy of item with the given attributes set. item may be nil.
+func overlay(item map[string]*dynamodb.AttributeValue, attrs ...map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	merged := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		merged[k] = v
+	}
+	for _, set := range attrs {
+		for k, v := range set {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
 func (c *Cache) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGetItemInput, opts ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	if !c.Enabled() {
+		return c.DynamoDB.BatchGetItemWithContext(ctx, input, opts...)
+	}
+
 	schemas := make(map[string][]*dynamodb.KeySchemaElement)
+	// generations of the items fetched, see fillItem
+	gens := make(map[string]generation)
+	// UnprocessedKeys is left nil so an all-cached response
+	// doesn't look like it has unprocessed keys to callers checking for nil
 	fake := &dynamodb.BatchGetItemOutput{
-		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue),
-		UnprocessedKeys: make(map[string]*dynamodb.KeysAndAttributes),
+		Responses: make(map[string][]map[string]*dynamodb.AttributeValue),
 	}
 	var newReq map[string]*dynamodb.KeysAndAttributes
+	// tables whose results are passed through without caching
+	var uncached map[string]bool
+	passthrough := func(table string, req *dynamodb.KeysAndAttributes) {
+		if newReq == nil {
+			newReq = make(map[string]*dynamodb.KeysAndAttributes)
+		}
+		if uncached == nil {
+			uncached = make(map[string]bool)
+		}
+		newReq[table] = req
+		uncached[table] = true
+	}
+	// normalized projections of projected tables, whose items go in the projection cache
+	projs := make(map[string]string)
 	for table, req := range input.RequestItems {
+		decision := c.decide(ctx, "BatchGetItem", table)
+		if decision == Bypass || !c.isAllowed(table) {
+			passthrough(table, req)
+			continue
+		}
+
 		schema, ok := schemas[table]
 		if !ok {
 			var err error
-			schema, err = c.schemaOf(table)
+			schema, err = c.schemaOf(ctx, table, opts...)
 			if err != nil {
-				return nil, err
+				c.degrade(err)
+				passthrough(table, req)
+				continue
 			}
 			schemas[table] = schema
 		}
 
+		// projected items are partial, so they can't be served from or stored in the item cache
+		var proj string
+		if isProjected(req.ProjectionExpression, req.AttributesToGet) {
+			proj = projectionKey(req.ProjectionExpression, req.AttributesToGet, req.ExpressionAttributeNames)
+			// without the key in the results, there's no telling which item is which
+			if !projectsKey(proj, schema) {
+				passthrough(table, req)
+				continue
+			}
+			projs[table] = proj
+		}
+		// like DynamoDB, respond for every table, even if none of its items exist
+		fake.Responses[table] = []map[string]*dynamodb.AttributeValue{}
+
 		var newKeys []map[string]*dynamodb.AttributeValue
 
 		for _, k := range req.Keys {
+			kstart := c.keyStart()
 			key := itemKey(table, k, schema)
-			if item, ok := c.getItem(key); ok {
-				c.log("batch get cached", key)
-				c.incHit()
-				if item != none {
+			c.timeKey(kstart)
+			if decision == Refresh {
+				c.deleteItem(table, key)
+			}
+			// a cached item can't satisfy a strongly consistent read, but the result can refresh the cache
+			if aws.BoolValue(req.ConsistentRead) {
+				gens[key] = c.itemGen(table, key)
+				newKeys = append(newKeys, k)
+				continue
+			}
+			var item interface{}
+			var ok bool
+			if proj != "" {
+				item, ok = c.getProjection(table, key, proj)
+			} else {
+				item, ok = c.getItem(table, key)
+			}
+			if c.lookup(ctx, ok, LogEntry{Op: "BatchGetItem", Table: table, Key: key}) {
+				if item != none && !c.softDeleted(item) {
 					fake.Responses[table] = append(fake.Responses[table], item.(map[string]*dynamodb.AttributeValue))
 				}
 			} else {
-				c.log("batch get NOT cached!!", key)
-				c.incMiss()
+				if !ok {
+					gens[key] = c.itemGen(table, key)
+				}
 				newKeys = append(newKeys, k)
 			}
 		}
@@ -319,9 +994,12 @@ func (c *Cache) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGe
 			if newReq == nil {
 				newReq = make(map[string]*dynamodb.KeysAndAttributes)
 			}
-			// TODO: support projections etc
 			newReq[table] = &dynamodb.KeysAndAttributes{
-				Keys: newKeys,
+				Keys:                     newKeys,
+				ConsistentRead:           req.ConsistentRead,
+				ProjectionExpression:     req.ProjectionExpression,
+				AttributesToGet:          req.AttributesToGet,
+				ExpressionAttributeNames: req.ExpressionAttributeNames,
 			}
 		}
 	}
@@ -334,20 +1012,38 @@ func (c *Cache) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGe
 		RequestItems:           newReq,
 		ReturnConsumedCapacity: input.ReturnConsumedCapacity,
 	}
+	start := time.Now()
 	out, err := c.DynamoDB.BatchGetItemWithContext(ctx, newInput, opts...)
+	c.timeBackend(start)
 	if err != nil {
+		for table := range newReq {
+			c.recordError(table, err)
+		}
 		return nil, err
 	}
 
 	for table, resp := range out.Responses {
+		if uncached[table] {
+			continue
+		}
 		for _, item := range resp {
 			key := itemKey(table, item, schemas[table])
-			c.log("batch get caching", key)
-			c.setItem(key, item)
+			// keys without a generation were dry run hits, which stay as they were
+			if _, ok := gens[key]; !ok || !c.admit("BatchGetItem", table, key) {
+				continue
+			}
+			if proj, ok := projs[table]; ok {
+				c.fillProjection(ctx, "BatchGetItem", table, key, proj, item, gens[key])
+			} else {
+				c.fillItem(ctx, opBatchGetItem, table, key, item, gens[key])
+			}
 		}
 	}
 
 	for table, keys := range newReq {
+		if uncached[table] {
+			continue
+		}
 	next:
 		for _, k := range keys.Keys {
 			for _, got := range out.Responses[table] {
@@ -363,15 +1059,26 @@ func (c *Cache) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGe
 				}
 			}
 			key := itemKey(table, k, schemas[table])
-			c.setItem(key, none)
-			c.log("batch get, caching empty:", key)
+			if _, ok := gens[key]; !ok || !c.admit("BatchGetItem", table, key) {
+				continue
+			}
+			if proj, ok := projs[table]; ok {
+				c.fillProjection(ctx, "BatchGetItem", table, key, proj, none, gens[key])
+			} else {
+				c.fillItem(ctx, opBatchGetItem, table, key, none, gens[key])
+			}
 		}
 	}
 
+	c.withoutSoftDeleted(out, uncached)
+
 	if len(fake.Responses) == 0 {
 		return out, err
 	}
 
+	if out.Responses == nil {
+		out.Responses = make(map[string][]map[string]*dynamodb.AttributeValue, len(fake.Responses))
+	}
 	for table, resp := range fake.Responses {
 		out.Responses[table] = append(out.Responses[table], resp...)
 	}
@@ -379,26 +1086,43 @@ func (c *Cache) BatchGetItemWithContext(ctx aws.Context, input *dynamodb.BatchGe
 }
 
 func (c *Cache) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
-	prefetch := c.newPrefetcher()
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.Enabled() {
+		return c.DynamoDB.BatchWriteItemWithContext(ctx, input, opts...)
+	}
+
+	prefetch := c.newPrefetcher(ctx, "BatchWriteItem", opts...)
 	for table, reqs := range input.RequestItems {
 		for _, req := range reqs {
 			if req.DeleteRequest != nil {
 				prefetch.add(table, req.DeleteRequest.Key)
+			} else if req.PutRequest != nil && c.batchPutPrefetch {
+				// the overwritten item's global index partitions may differ from the new one's
+				if desc, err := c.desc(ctx, table, opts...); err == nil && len(desc.Table.GlobalSecondaryIndexes) > 0 {
+					prefetch.add(table, keyOf(req.PutRequest.Item, desc.Table.KeySchema))
+				}
 			}
 		}
 	}
-	if err := prefetch.run(ctx, opts...); err != nil {
+	if err := prefetch.run(); err != nil {
 		return nil, err
 	}
 
 	out, err := c.DynamoDB.BatchWriteItemWithContext(ctx, input, opts...)
 	if err != nil {
+		for table := range input.RequestItems {
+			c.recordError(table, err)
+		}
 		return out, err
 	}
+	inv := c.newInvalidation(ctx, opts...)
 	for table, reqs := range input.RequestItems {
-		schema, err := c.schemaOf(table)
+		schema, err := c.schemaOf(ctx, table, opts...)
 		if err != nil {
 			// TODO: probably bad to error out here
+			inv.run()
 			return out, err
 		}
 	next:
@@ -413,9 +1137,9 @@ func (c *Cache) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.Batch
 					}
 				}
 				key := itemKey(table, req.DeleteRequest.Key, schema)
-				c.log("batch delete", key)
-				c.setItem(key, none)
-				c.invalidateRough(table, req.DeleteRequest.Key)
+				c.setItem(ctx, opBatchWriteItem, table, key, none)
+				snapshotFrom(ctx).forget(key)
+				inv.add(table, req.DeleteRequest.Key)
 			} else if req.PutRequest != nil {
 				for _, unprocessed := range out.UnprocessedItems[table] {
 					if unprocessed.PutRequest == nil {
@@ -426,17 +1150,26 @@ func (c *Cache) BatchWriteItemWithContext(ctx aws.Context, input *dynamodb.Batch
 					}
 				}
 				key := itemKey(table, req.PutRequest.Item, schema)
-				c.log("batch put", key)
-				c.setItem(key, req.PutRequest.Item)
-				c.invalidate(table, req.PutRequest.Item)
+				c.setItem(ctx, opBatchWriteItem, table, key, req.PutRequest.Item)
+				snapshotFrom(ctx).forget(key)
+				inv.add(table, req.PutRequest.Item)
 			}
 		}
 	}
+	prefetch.invalidate(inv)
+	inv.run()
 	return out, err
 }
 
 func (c *Cache) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
-	prefetch := c.newPrefetcher()
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if !c.Enabled() || !namesTables(input.TransactItems) {
+		return c.DynamoDB.TransactWriteItemsWithContext(ctx, input, opts...)
+	}
+
+	prefetch := c.newPrefetcher(ctx, "TransactWriteItems", opts...)
 	for _, item := range input.TransactItems {
 		if item.Update != nil {
 			prefetch.add(*item.Update.TableName, item.Update.Key)
@@ -445,190 +1178,361 @@ func (c *Cache) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.T
 			prefetch.add(*item.Delete.TableName, item.Delete.Key)
 		}
 	}
-	if err := prefetch.run(ctx, opts...); err != nil {
+	if err := prefetch.run(); err != nil {
 		return nil, err
 	}
 
 	out, err := c.DynamoDB.TransactWriteItemsWithContext(ctx, input, opts...)
 	if err != nil {
+		for _, table := range transactTables(input) {
+			c.recordError(table, err)
+		}
 		return out, err
 	}
+	inv := c.newInvalidation(ctx, opts...)
 	for _, req := range input.TransactItems {
 		switch {
 		case req.Put != nil:
-			schema, err := c.schemaOf(*req.Put.TableName)
+			schema, err := c.schemaOf(ctx, *req.Put.TableName, opts...)
 			if err != nil {
+				inv.run()
 				return out, err
 			}
 			key := itemKey(*req.Put.TableName, req.Put.Item, schema)
-			c.log("transact put", key)
-			c.setItem(key, req.Put.Item)
-			c.invalidate(*req.Put.TableName, req.Put.Item)
+			c.setItem(ctx, opTransactWriteItems, *req.Put.TableName, key, req.Put.Item)
+			snapshotFrom(ctx).forget(key)
+			inv.add(*req.Put.TableName, req.Put.Item)
 		case req.Delete != nil:
-			schema, err := c.schemaOf(*req.Delete.TableName)
+			schema, err := c.schemaOf(ctx, *req.Delete.TableName, opts...)
 			if err != nil {
+				inv.run()
 				return out, err
 			}
 			key := itemKey(*req.Delete.TableName, req.Delete.Key, schema)
-			c.log("transact delete", key)
-			c.setItem(key, none)
-			c.invalidateRough(*req.Delete.TableName, req.Delete.Key)
+			c.setItem(ctx, opTransactWriteItems, *req.Delete.TableName, key, none)
+			snapshotFrom(ctx).forget(key)
+			inv.add(*req.Delete.TableName, req.Delete.Key)
 		case req.Update != nil:
-			schema, err := c.schemaOf(*req.Update.TableName)
+			schema, err := c.schemaOf(ctx, *req.Update.TableName, opts...)
 			if err != nil {
+				inv.run()
 				return out, err
 			}
 			key := itemKey(*req.Update.TableName, req.Update.Key, schema)
-			c.log("transact update", key)
-			c.deleteItem(key)
-			c.invalidateRough(*req.Update.TableName, req.Update.Key)
+			c.log(LogEntry{Op: "TransactWriteItems", Table: *req.Update.TableName, Key: key, Msg: "deleting"})
+			c.deleteItem(*req.Update.TableName, key)
+			snapshotFrom(ctx).forget(key)
+			inv.add(*req.Update.TableName, req.Update.Key)
+		case req.ConditionCheck != nil:
+			// a condition check doesn't change its item, so its cached copy stays valid.
+			// If the check had failed, the whole transaction would have, and we wouldn't be here.
 		}
 	}
+	prefetch.invalidate(inv)
+	inv.run()
 	return out, err
 }
 
+// namesTables reports whether every write in a transaction names its table.
+// If not, the transaction is left for DynamoDB to reject.
+func namesTables(items []*dynamodb.TransactWriteItem) bool {
+	for _, item := range items {
+		switch {
+		case item.Put != nil && item.Put.TableName == nil,
+			item.Delete != nil && item.Delete.TableName == nil,
+			item.Update != nil && item.Update.TableName == nil:
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Cache) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (*dynamodb.QueryOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
+		return c.DynamoDB.QueryWithContext(ctx, input, opts...)
+	}
+	decision := c.decide(ctx, "Query", *input.TableName)
+	if decision == Bypass || (input.IndexName != nil && !c.cachesIndex(*input.TableName, *input.IndexName)) {
+		return c.DynamoDB.QueryWithContext(ctx, input, opts...)
+	}
+	// DynamoDB rejects strongly consistent reads of GSIs, so leave it to say so
+	if aws.BoolValue(input.ConsistentRead) && input.IndexName != nil && c.isGSI(ctx, *input.TableName, *input.IndexName, opts...) {
 		return c.DynamoDB.QueryWithContext(ctx, input, opts...)
 	}
 
 	// spew.Dump(input)
-	var idx string
-	var schema []*dynamodb.KeySchemaElement
-	var err error
-	if input.IndexName == nil {
-		schema, err = c.schemaOf(*input.TableName)
-	} else {
-		schema, err = c.schemaOfIndex(*input.TableName, *input.IndexName)
-		idx = *input.IndexName
-	}
+	schema, tkey, key, err := c.queryKeys(ctx, input, opts...)
 	if err != nil {
-		return nil, err
+		if !errors.Is(err, errUnsupportedKeyCondition) {
+			c.degrade(err)
+		}
+		return c.DynamoDB.QueryWithContext(ctx, input, opts...)
 	}
-	var tkey string
-	if len(schema) == 1 {
-		tkey = tableHashKey(*input.TableName, nil, idx)
-	} else {
-		tkey = tableHashKey(*input.TableName, input.KeyConditions[*schema[0].AttributeName].AttributeValueList[0], idx)
+	if decision == Refresh {
+		c.deleteQuery(tkey, key)
 	}
-	key := queryKey(input, schema)
-	if out, ok := c.getQuery(tkey, key); ok {
-		c.log("cached query:", tkey, key)
-		c.incHit()
-		return out.(*dynamodb.QueryOutput), nil
+	cached, ok := c.getQuery(tkey, key)
+	if c.lookup(ctx, ok, LogEntry{Op: "Query", Table: *input.TableName, Key: key, Args: []interface{}{tkey}}) {
+		return cachedQuery(cached.(*dynamodb.QueryOutput), input), nil
 	}
-	c.incMiss()
+	start := time.Now()
 	out, err := c.DynamoDB.QueryWithContext(ctx, input, opts...)
+	c.timeBackend(start)
 	if err != nil {
+		c.recordError(*input.TableName, err)
 		return out, err
 	}
-	c.log("saving query:", tkey, key)
-	c.setQuery(tkey, key, out)
+	// a dry run hit stays as it was
+	if !ok {
+		c.setQuery(tkey, key, input, cacheableQuery(out))
+		c.cacheGSIItems(ctx, input, schema, out, opts...)
+	}
 	return out, err
 }
 
+// queryKeys returns the key schema input queries, and the partition and key its results
+// are cached under, or an error if they can't be cached.
+func (c *Cache) queryKeys(ctx aws.Context, input *dynamodb.QueryInput, opts ...request.Option) (schema []*dynamodb.KeySchemaElement, partition, key string, err error) {
+	var idx string
+	if input.IndexName == nil {
+		schema, err = c.schemaOf(ctx, *input.TableName, opts...)
+	} else {
+		schema, err = c.schemaOfIndex(ctx, *input.TableName, *input.IndexName, opts...)
+		idx = *input.IndexName
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	conds, err := keyConditions(input, schema)
+	if err != nil {
+		return nil, "", "", err
+	}
+	var hk *dynamodb.AttributeValue
+	if rangeKey(schema) != "" {
+		hk = conds[hashKey(schema)].AttributeValueList[0]
+	}
+	partition = c.queryPartition(*input.TableName, idx, schema, hk)
+	kstart := c.keyStart()
+	key = queryKey(input, schema, conds)
+	c.timeKey(kstart)
+	return schema, partition, key, nil
+}
+
 func (c *Cache) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput, opts ...request.Option) (*dynamodb.ScanOutput, error) {
-	if !c.isAllowed(*input.TableName) {
+	if !c.Enabled() || input.TableName == nil || !c.isAllowed(*input.TableName) {
+		return c.DynamoDB.ScanWithContext(ctx, input, opts...)
+	}
+	decision := c.decide(ctx, "Scan", *input.TableName)
+	if decision == Bypass {
+		return c.DynamoDB.ScanWithContext(ctx, input, opts...)
+	}
+	// Limit caps the number of items evaluated, not returned, so a limited and filtered
+	// scan returns whichever matches happen to be within the first Limit items.
+	// Small shifts in the underlying data change that window entirely,
+	// so a cached result can differ from a fresh one in ways that are hard to notice.
+	if c.skipLimitedFilterScans && input.Limit != nil && input.FilterExpression != nil {
+		return c.DynamoDB.ScanWithContext(ctx, input, opts...)
+	}
+	// a cached result can't satisfy a strongly consistent read
+	if aws.BoolValue(input.ConsistentRead) {
 		return c.DynamoDB.ScanWithContext(ctx, input, opts...)
 	}
 
-	schema, err := c.schemaOf(*input.TableName)
+	schema, err := c.schemaOf(ctx, *input.TableName, opts...)
 	if err != nil {
-		return nil, err
+		c.degrade(err)
+		return c.DynamoDB.ScanWithContext(ctx, input, opts...)
 	}
 
+	kstart := c.keyStart()
 	key := scanKey(input, schema)
-	if out, ok := c.getScan(*input.TableName, key); ok {
-		c.log("returning cached scan", key)
-		c.incHit()
-		return out.(*dynamodb.ScanOutput), nil
+	c.timeKey(kstart)
+	layer := c.scanLayer(input)
+	if decision == Refresh {
+		c.deleteScan(layer, key)
+	}
+	cached, ok := c.getScan(layer, key)
+	if c.lookup(ctx, ok, LogEntry{Op: "Scan", Table: layer, Key: key}) {
+		return cachedScan(cached.(*dynamodb.ScanOutput), input), nil
 	}
 
+	start := time.Now()
 	out, err := c.DynamoDB.ScanWithContext(ctx, input, opts...)
+	c.timeBackend(start)
 	if err != nil {
+		c.recordError(*input.TableName, err)
 		return out, err
 	}
-	c.log("caching scan", key)
-	c.incMiss()
-	c.setScan(*input.TableName, key, out)
+	// a dry run hit stays as it was
+	if !ok {
+		c.setScan(layer, key, cacheableScan(out))
+	}
 	return out, err
 }
 
+// lookup counts a cache lookup as a hit or a miss, and reports whether to serve the hit.
+// It logs e as the hit or miss and passes it to the trace hook, if any. In dry run mode,
+// hits aren't served and every decision is logged even without Debug, see WithDryRun.
+func (c *Cache) lookup(ctx aws.Context, found bool, e LogEntry) bool {
+	c.trace(ctx, found, e)
+	if found {
+		c.incHit()
+		e.Msg = "hit"
+	} else {
+		c.incMiss()
+		e.Msg = "miss"
+	}
+	if c.dryRun {
+		e.Msg = "dry run: " + e.Msg
+		if c.logger != nil {
+			c.logger.Log(e)
+		} else {
+			log.Println("localcache:", e)
+		}
+		return false
+	}
+	c.log(e)
+	return found
+}
+
 func (c *Cache) incHit() {
-	c.hits.Add(1)
+	c.stats.update(func(s *Stats) { s.HitCount++ })
 }
 
 func (c *Cache) incMiss() {
-	c.miss.Add(1)
+	c.stats.update(func(s *Stats) { s.MissCount++ })
 }
 
+// HitRatio returns the fraction of cacheable reads that were served from the cache.
+// It returns 0 when there haven't been any, see HitStats to tell the difference.
 func (c *Cache) HitRatio() float64 {
-	hits := c.hits.Load()
-	miss := c.miss.Load()
-	total := hits + miss
-	return float64(hits) / max(float64(total), 1)
+	ratio, _ := c.HitStats()
+	return ratio
+}
+
+// HitStats returns the hit ratio and the number of cacheable reads it was calculated from.
+// Idle caches report zero samples, so callers can hold off on judging the ratio
+// until there's been enough traffic.
+func (c *Cache) HitStats() (ratio float64, samples uint64) {
+	stats := c.Stats()
+	hits := stats.HitCount
+	total := hits + stats.MissCount
+	return float64(hits) / max(float64(total), 1), total
 }
 
-func (c *Cache) log(v ...interface{}) {
-	if c.Debug {
-		log.Println(v...)
+// handleError reports errors that can't be returned to a caller,
+// such as those from background work or post-write invalidation.
+func (c *Cache) handleError(err error) {
+	c.log(LogEntry{Msg: "error", Args: []interface{}{err}})
+	if c.onError != nil {
+		c.onError(err)
 	}
 }
 
-func (c *Cache) schemaOf(table string) ([]*dynamodb.KeySchemaElement, error) {
-	desc, err := c.desc(table)
+// cachesIndex reports whether queries against the given index are cached and invalidated,
+// see WithInvalidatedIndexes.
+func (c *Cache) cachesIndex(table, index string) bool {
+	indexes, ok := c.cachedIndexes[table]
+	if !ok {
+		return true
+	}
+	_, ok = indexes[index]
+	return ok
+}
+
+func (c *Cache) schemaOf(ctx aws.Context, table string, opts ...request.Option) ([]*dynamodb.KeySchemaElement, error) {
+	desc, err := c.desc(ctx, table, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if err := validateKeySchema(desc.Table.KeySchema); err != nil {
+		return nil, fmt.Errorf("localcache: table %s: %w", table, err)
+	}
 	return desc.Table.KeySchema, nil
 }
 
-func (c *Cache) schemaOfIndex(table, index string) ([]*dynamodb.KeySchemaElement, error) {
-	desc, err := c.desc(table)
+func (c *Cache) schemaOfIndex(ctx aws.Context, table, index string, opts ...request.Option) ([]*dynamodb.KeySchemaElement, error) {
+	desc, err := c.desc(ctx, table, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if schema, ok := indexSchema(desc, index); ok {
+		return validIndexSchema(table, index, schema)
+	}
+
+	notFound := fmt.Errorf("localcache: index not found: %s %s", table, index)
+	if c.tableDesc.indexMissing(c.region(), table, index) {
+		return nil, notFound
+	}
+
+	// our cached description might predate the index, so check again before giving up
+	c.log(LogEntry{Table: table, Msg: "index not found, refreshing desc", Args: []interface{}{index}})
+	c.forgetDesc(table)
+	desc, err = c.desc(ctx, table, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if schema, ok := indexSchema(desc, index); ok {
+		return validIndexSchema(table, index, schema)
+	}
 
+	c.tableDesc.missIndex(c.region(), table, index)
+	return nil, notFound
+}
+
+func validIndexSchema(table, index string, schema []*dynamodb.KeySchemaElement) ([]*dynamodb.KeySchemaElement, error) {
+	if err := validateKeySchema(schema); err != nil {
+		return nil, fmt.Errorf("localcache: table %s index %s: %w", table, index, err)
+	}
+	return schema, nil
+}
+
+func indexSchema(desc *dynamodb.DescribeTableOutput, index string) ([]*dynamodb.KeySchemaElement, bool) {
 	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
 		if *gsi.IndexName == index {
-			return gsi.KeySchema, nil
+			return gsi.KeySchema, true
 		}
 	}
 	for _, lsi := range desc.Table.LocalSecondaryIndexes {
 		if *lsi.IndexName == index {
-			return lsi.KeySchema, nil
+			return lsi.KeySchema, true
 		}
 	}
-
-	panic("index not found: " + table + " " + index)
-}
-
-func (c *Cache) desc(table string) (*dynamodb.DescribeTableOutput, error) {
-	item := c.tableDesc.Get(table)
-	if item == nil {
-		out, err := c.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{TableName: &table})
-		if err != nil {
-			return nil, err
-		}
-		c.tableDesc.Set(table, out, 24*time.Hour)
-		c.log("caching desc", out)
-		return out, nil
-	}
-	return item.Value().(*dynamodb.DescribeTableOutput), nil
+	return nil, false
 }
 
+// prefetcher reads the current version of items about to be changed,
+// so their query partitions can be invalidated even when the write
+// itself doesn't tell us what the old item looked like.
 type prefetcher struct {
 	cache *Cache
+	ctx   aws.Context
+	op    string
+	opts  []request.Option
 	batch *dynamodb.BatchGetItemInput
+	old   map[string][]map[string]*dynamodb.AttributeValue
 }
 
-func (c *Cache) newPrefetcher() *prefetcher {
+func (c *Cache) newPrefetcher(ctx aws.Context, op string, opts ...request.Option) *prefetcher {
 	return &prefetcher{
 		cache: c,
+		ctx:   ctx,
+		op:    op,
+		opts:  opts,
 	}
 }
 
 func (p *prefetcher) add(table string, key map[string]*dynamodb.AttributeValue) {
+	// no need to read items we already know. Peek, since this isn't a use of the item
+	if schema, err := p.cache.schemaOf(p.ctx, table, p.opts...); err == nil {
+		if item, ok := p.cache.peekItem(table, itemKey(table, key, schema)); ok {
+			if item != none {
+				p.remember(table, item.(map[string]*dynamodb.AttributeValue))
+			}
+			return
+		}
+	}
+
 	if p.batch == nil {
 		p.batch = &dynamodb.BatchGetItemInput{
 			RequestItems: make(map[string]*dynamodb.KeysAndAttributes),
@@ -637,25 +1541,67 @@ func (p *prefetcher) add(table string, key map[string]*dynamodb.AttributeValue)
 	kas := p.batch.RequestItems[table]
 	if kas == nil {
 		kas = &dynamodb.KeysAndAttributes{
-			ConsistentRead: aws.Bool(true),
+			ConsistentRead: aws.Bool(p.cache.prefetchConsistent(table)),
 		}
 		p.batch.RequestItems[table] = kas
 	}
 	kas.Keys = append(kas.Keys, key)
 }
 
-func (p *prefetcher) run(ctx aws.Context, opts ...request.Option) error {
-	if p.batch == nil {
-		return nil
+// prefetchConsistent reports whether prefetches from table use strongly consistent reads.
+func (c *Cache) prefetchConsistent(table string) bool {
+	if consistent, ok := c.prefetchConsistency[table]; ok {
+		return consistent
 	}
-	err := p.cache.BatchGetItemPagesWithContext(ctx, p.batch, func(out *dynamodb.BatchGetItemOutput, _ bool) bool {
-		for table, resps := range out.Responses {
-			for _, resp := range resps {
-				p.cache.log("hacky invalidate:", table, resp)
-				p.cache.invalidate(table, resp)
+	return !c.prefetchEventual
+}
+
+func (p *prefetcher) remember(table string, item map[string]*dynamodb.AttributeValue) {
+	if p.old == nil {
+		p.old = make(map[string][]map[string]*dynamodb.AttributeValue)
+	}
+	p.old[table] = append(p.old[table], item)
+}
+
+func (p *prefetcher) run() error {
+	var err error
+	if p.batch != nil {
+		err = p.cache.BatchGetItemPagesWithContext(p.ctx, p.batch, func(out *dynamodb.BatchGetItemOutput, _ bool) bool {
+			for table, resps := range out.Responses {
+				for _, resp := range resps {
+					p.cache.log(LogEntry{Op: p.op, Table: table, Msg: "prefetched", Args: []interface{}{resp}})
+					p.remember(table, resp)
+				}
 			}
-		}
-		return true
-	}, opts...)
+			return true
+		}, p.opts...)
+	}
+	inv := p.cache.newInvalidation(p.ctx, p.opts...)
+	// the write hasn't happened yet, so there's nothing to publish
+	inv.keys = nil
+	p.invalidate(inv)
+	inv.run()
 	return err
 }
+
+// item returns the prefetched item with the given key, or nil if there isn't one.
+func (p *prefetcher) item(table string, key map[string]*dynamodb.AttributeValue, schema []*dynamodb.KeySchemaElement) map[string]*dynamodb.AttributeValue {
+	for _, item := range p.old[table] {
+		if keyEq(keyOf(item, schema), key) {
+			return item
+		}
+	}
+	return nil
+}
+
+// invalidate adds the old items' query partitions to inv again. Call it after the write
+// succeeds: a query that raced with the write may have re-cached a partition
+// the item was in, after run invalidated it but before the write landed.
+func (p *prefetcher) invalidate(inv *invalidation) {
+	for table, items := range p.old {
+		for _, item := range items {
+			p.cache.log(LogEntry{Op: p.op, Table: table, Msg: "invalidate prefetched", Args: []interface{}{item}})
+			inv.add(table, item)
+		}
+	}
+}
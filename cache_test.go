@@ -0,0 +1,707 @@
+package localcache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func getItem(t *testing.T, c *Cache, k map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	t.Helper()
+	out, err := c.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{TableName: aws.String("T"), Key: k})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Item
+}
+
+func TestPrefetchCachedItems(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1"))
+	getItem(t, c, key("a", "1"))
+	getItem(t, c, key("b", "1"))
+
+	_, err := c.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{
+			"T": {
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: key("a", "1")}},
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: key("b", "1")}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("BatchGetItem"); got != 0 {
+		t.Errorf("prefetched cached items with %d BatchGetItem calls", got)
+	}
+}
+
+// cachingLog counts the entries cached, as logged.
+type cachingLog struct {
+	mu     sync.Mutex
+	cached int
+}
+
+func (l *cachingLog) Log(e LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if strings.HasPrefix(e.Msg, "caching") {
+		l.cached++
+	}
+}
+
+func (l *cachingLog) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cached
+}
+
+func TestDryRunHitsDontRefill(t *testing.T) {
+	ctx := context.Background()
+	l := new(cachingLog)
+	c, f := newTestCache(t, WithDryRun(), WithLogger(l))
+	f.put("T", item("pk", "a", "sk", "1", "g", "x", "v", "1"))
+	reads := func() {
+		t.Helper()
+		getItem(t, c, key("a", "1"))
+		getItem(t, c, key("a", "2"))
+		_, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1"), ProjectionExpression: aws.String("v")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{"T": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1"), key("a", "3")}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.QueryWithContext(ctx, indexQuery("gsi", "x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reads()
+	filled := l.count()
+	if filled == 0 {
+		t.Fatal("nothing cached by the first reads")
+	}
+	f.put("T", item("pk", "a", "sk", "3", "v", "new"))
+	reads()
+	if got := l.count(); got != filled {
+		t.Errorf("would-be hits cached %d more entries", got-filled)
+	}
+}
+
+func TestQueryTTLFunc(t *testing.T) {
+	ctx := context.Background()
+	ttls := map[string]time.Duration{"nope": DontCache, "zero": 0, "negative": -time.Second, "minute": time.Minute}
+	c, f := newTestCache(t, WithQueryTTLFunc(func(input *dynamodb.QueryInput) time.Duration {
+		return ttls[aws.StringValue(input.ExpressionAttributeValues[":g"].S)]
+	}))
+	for g, ttl := range ttls {
+		before := f.count("Query")
+		for i := 0; i < 2; i++ {
+			if _, err := c.QueryWithContext(ctx, indexQuery("gsi", g)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := 1
+		if ttl == DontCache {
+			want = 2
+		}
+		if got := f.count("Query") - before; got != want {
+			t.Errorf("TTL %v: queried DynamoDB %d times, want %d", ttl, got, want)
+		}
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	c, _ := newTestCache(t, WithItemTTL(time.Hour), WithNegativeTTL(time.Minute))
+	getItem(t, c, key("a", "1"))
+	if ttl, ok := c.ItemTTL("T", key("a", "1")); !ok || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("ItemTTL() of missing item = %v, %v; want about a minute", ttl, ok)
+	}
+}
+
+func TestItemTTL(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithItemTTL(time.Hour))
+	f.put("T", item("pk", "a", "sk", "1"))
+	if _, ok := c.ItemTTL("T", key("a", "1")); ok {
+		t.Error("item cached before reading it")
+	}
+	if _, err := c.CanCache(ctx, "T"); err != nil {
+		t.Fatal(err)
+	}
+
+	getItem(t, c, key("a", "1"))
+	if ttl, ok := c.ItemTTL("T", key("a", "1")); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("ItemTTL() = %v, %v; want about an hour", ttl, ok)
+	}
+	getItem(t, c, key("a", "2"))
+	if _, ok := c.ItemTTL("T", key("a", "2")); !ok {
+		t.Error("missing item not cached")
+	}
+	if _, ok := c.ItemTTL("nope", key("a", "1")); ok {
+		t.Error("item cached for unknown table")
+	}
+}
+
+func TestScanDoesntCacheItems(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+	f.put("T", item("pk", "b", "sk", "1", "g", "x"))
+	for _, index := range []*string{nil, aws.String("gsi"), aws.String("keys")} {
+		out, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T"), IndexName: index})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Items) != 2 {
+			t.Fatalf("scanned %d items", len(out.Items))
+		}
+	}
+	if n := c.items.ItemCount(); n != 0 {
+		t.Errorf("scans cached %d items", n)
+	}
+}
+
+// TestNilTableName checks that inputs without a table name reach the SDK,
+// which rejects them before sending anything.
+func TestNilTableName(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	calls := map[string]func() error{
+		"GetItem": func() error {
+			_, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{Key: key("a", "1")})
+			return err
+		},
+		"PutItem": func() error {
+			_, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{Item: key("a", "1")})
+			return err
+		},
+		"UpdateItem": func() error {
+			_, err := c.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{Key: key("a", "1")})
+			return err
+		},
+		"DeleteItem": func() error {
+			_, err := c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{Key: key("a", "1")})
+			return err
+		},
+		"Query": func() error {
+			_, err := c.QueryWithContext(ctx, &dynamodb.QueryInput{KeyConditionExpression: aws.String("pk = :pk")})
+			return err
+		},
+		"Scan": func() error {
+			_, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{})
+			return err
+		},
+		"TransactWriteItems": func() error {
+			_, err := c.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+				TransactItems: []*dynamodb.TransactWriteItem{{Put: &dynamodb.Put{Item: key("a", "1")}}},
+			})
+			return err
+		},
+	}
+	for op, call := range calls {
+		if err := call(); err == nil {
+			t.Errorf("%s without a table name succeeded", op)
+		}
+		if got := f.count(op); got != 0 {
+			t.Errorf("%s without a table name was sent %d times", op, got)
+		}
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	for _, tc := range []struct {
+		opts  []Option
+		stale bool
+	}{
+		{nil, false},
+		{[]Option{WithServeStaleOnError()}, true},
+		{[]Option{WithServeStaleOnError(), WithStaleGrace(0)}, true},
+		{[]Option{WithServeStaleOnError(), WithStaleGrace(time.Millisecond)}, false},
+	} {
+		c, f := newTestCache(t, append(tc.opts, WithItemTTL(10*time.Millisecond))...)
+		f.put("T", item("pk", "a", "sk", "1"))
+		getItem(t, c, key("a", "1"))
+		time.Sleep(30 * time.Millisecond)
+
+		f.on("GetItem", func([]byte) (interface{}, error) { return nil, errInternal })
+		out, err := c.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")})
+		if served := err == nil && out.Item["pk"] != nil; served != tc.stale {
+			t.Errorf("%d options: served stale item: %v (err: %v), want %v", len(tc.opts), served, err, tc.stale)
+		}
+		if got, want := c.Stats().StaleServed, map[bool]uint64{true: 1}[tc.stale]; got != want {
+			t.Errorf("%d options: StaleServed = %d, want %d", len(tc.opts), got, want)
+		}
+	}
+}
+
+// TestStatementProjections checks that a PartiQL write drops the projections
+// of its own table's items, but not other tables'.
+func TestStatementProjections(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(testDesc("U"))
+	f.on("ExecuteStatement", func([]byte) (interface{}, error) {
+		return &dynamodb.ExecuteStatementOutput{}, nil
+	})
+	getProjected := func(table string) {
+		t.Helper()
+		_, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(table), Key: key("a", "1"), ProjectionExpression: aws.String("pk")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	getProjected("T")
+	getProjected("U")
+	if _, err := c.ExecuteStatementWithContext(ctx, &dynamodb.ExecuteStatementInput{Statement: aws.String(`DELETE FROM "T" WHERE pk = 'a' AND sk = '1'`)}); err != nil {
+		t.Fatal(err)
+	}
+	before := f.count("GetItem")
+	getProjected("U")
+	if got := f.count("GetItem") - before; got != 0 {
+		t.Errorf("projection of another table refetched %d times", got)
+	}
+	getProjected("T")
+	if got := f.count("GetItem") - before; got != 1 {
+		t.Errorf("projection of the statement's table fetched %d times, want 1", got)
+	}
+}
+
+// keyRecorder is a backend that records the primary keys it's given, by backend name.
+type keyRecorder struct {
+	Backend
+	name string
+	mu   *sync.Mutex
+	keys map[string]string
+}
+
+func (r keyRecorder) Set(primary, secondary string, value interface{}, ttl time.Duration) {
+	r.mu.Lock()
+	r.keys[r.name] = primary
+	r.mu.Unlock()
+	r.Backend.Set(primary, secondary, value, ttl)
+}
+
+func TestBackendKeysVersioned(t *testing.T) {
+	ctx := context.Background()
+	rec := keyRecorder{mu: new(sync.Mutex), keys: make(map[string]string)}
+	c, f := newTestCache(t, WithBackend(func(name string) Backend {
+		r := rec
+		r.Backend = newCCacheBackend(nil)
+		r.name = name
+		return r
+	}))
+	f.put("T", item("pk", "a", "sk", "1"))
+	getItem(t, c, key("a", "1"))
+	if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1"), ProjectionExpression: aws.String("pk")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryWithContext(ctx, tableQuery("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.keys) != 4 {
+		t.Errorf("got primary keys %v, want one per backend", rec.keys)
+	}
+	for name, k := range rec.keys {
+		if !strings.HasPrefix(k, KeyVersion+":") {
+			t.Errorf("%s: primary key %q isn't prefixed by KeyVersion", name, k)
+		}
+	}
+}
+
+func TestBatchGetAllCached(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(testDesc("U"))
+	f.put("T", item("pk", "a", "sk", "1"))
+	f.put("T", item("pk", "a", "sk", "2"))
+	getItem(t, c, key("a", "1"))
+	getItem(t, c, key("a", "2"))
+	// cached as missing
+	if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("U"), Key: key("a", "1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := f.count("GetItem")
+	out, err := c.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			"T": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1"), key("a", "2")}},
+			"U": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("BatchGetItem") + f.count("GetItem") - before; n != 0 {
+		t.Errorf("called DynamoDB %d times", n)
+	}
+	if len(out.UnprocessedKeys) != 0 {
+		t.Errorf("unprocessed keys: %v", out.UnprocessedKeys)
+	}
+	if len(out.Responses) != 2 || len(out.Responses["T"]) != 2 || out.Responses["U"] == nil || len(out.Responses["U"]) != 0 {
+		t.Errorf("got responses %v, want 2 items of T and none of U", out.Responses)
+	}
+}
+
+// TestConsistentScan checks that strongly consistent scans bypass the cache,
+// even when an otherwise identical eventually consistent scan is cached.
+func TestConsistentScan(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1"))
+	scan := func(consistent bool) int {
+		t.Helper()
+		out, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T"), ConsistentRead: aws.Bool(consistent)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out.Items)
+	}
+	scan(false)
+	f.put("T", item("pk", "b", "sk", "1"))
+
+	before := f.count("Scan")
+	for i := 0; i < 2; i++ {
+		if n := scan(true); n != 2 {
+			t.Errorf("consistent scan returned %d items, want 2", n)
+		}
+	}
+	if n := scan(false); n != 1 {
+		t.Errorf("eventually consistent scan returned %d items, want the cached 1", n)
+	}
+	if got := f.count("Scan") - before; got != 2 {
+		t.Errorf("scanned DynamoDB %d times, want 2", got)
+	}
+}
+
+func TestItemTTLAttribute(t *testing.T) {
+	c, f := newTestCache(t, WithItemTTL(time.Hour), WithItemTTLAttribute("expires"))
+	now := time.Now()
+	for sk, expires := range map[string]time.Time{
+		"1": now.AddDate(10, 0, 0),
+		"2": now.Add(10 * time.Minute),
+		"3": now.Add(-time.Minute),
+	} {
+		it := item("pk", "a", "sk", sk)
+		it["expires"] = num(int(expires.Unix()))
+		f.put("T", it)
+		getItem(t, c, key("a", sk))
+	}
+
+	if ttl, ok := c.ItemTTL("T", key("a", "1")); !ok || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("item expiring in 10 years: ItemTTL() = %v, %v; want about the item TTL of an hour", ttl, ok)
+	}
+	if ttl, ok := c.ItemTTL("T", key("a", "2")); !ok || ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("item expiring in 10 minutes: ItemTTL() = %v, %v; want about 10 minutes", ttl, ok)
+	}
+	if n := c.items.ItemCount(); n != 2 {
+		t.Errorf("%d items stored, want 2 (not the expired one)", n)
+	}
+}
+
+// TestProjectedBatchGet checks that items read by a projected BatchGetItem
+// aren't served to a later GetItem of the whole item.
+func TestProjectedBatchGet(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1", "v", "x"))
+	out, err := c.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			"T": {
+				Keys:                     []map[string]*dynamodb.AttributeValue{key("a", "1")},
+				ProjectionExpression:     aws.String("pk, #sk"),
+				ExpressionAttributeNames: map[string]*string{"#sk": aws.String("sk")},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.Responses["T"]; len(got) != 1 || got[0]["v"] != nil {
+		t.Fatalf("projected batch got %v", got)
+	}
+
+	before := f.count("GetItem")
+	if v := getItem(t, c, key("a", "1"))["v"]; v == nil || *v.S != "x" {
+		t.Errorf("got v = %v after a projected batch, want x", v)
+	}
+	if got := f.count("GetItem") - before; got != 1 {
+		t.Errorf("read the full item %d times, want 1", got)
+	}
+}
+
+// TestConsumedCapacity checks that cached queries and scans report no capacity consumed,
+// and only when asked to, while misses pass on what DynamoDB reports.
+func TestConsumedCapacity(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	capacity := &dynamodb.ConsumedCapacity{TableName: aws.String("T"), CapacityUnits: aws.Float64(2.5)}
+	items := []map[string]*dynamodb.AttributeValue{item("pk", "a", "sk", "1")}
+	f.on("Query", func([]byte) (interface{}, error) {
+		return &dynamodb.QueryOutput{Items: items, Count: aws.Int64(1), ConsumedCapacity: capacity}, nil
+	})
+	f.on("Scan", func([]byte) (interface{}, error) {
+		return &dynamodb.ScanOutput{Items: items, Count: aws.Int64(1), ConsumedCapacity: capacity}, nil
+	})
+	read := func(mode string) (query, scan *dynamodb.ConsumedCapacity) {
+		t.Helper()
+		var rcc *string
+		if mode != "" {
+			rcc = aws.String(mode)
+		}
+		input := tableQuery("a")
+		input.ReturnConsumedCapacity = rcc
+		qout, err := c.QueryWithContext(ctx, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sout, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T"), ReturnConsumedCapacity: rcc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(qout.Items) != 1 || len(sout.Items) != 1 {
+			t.Fatalf("got %d and %d items, want 1 each", len(qout.Items), len(sout.Items))
+		}
+		return qout.ConsumedCapacity, sout.ConsumedCapacity
+	}
+
+	check := func(name string, want float64, ccs ...*dynamodb.ConsumedCapacity) {
+		t.Helper()
+		for _, cc := range ccs {
+			if cc == nil || aws.StringValue(cc.TableName) != "T" || aws.Float64Value(cc.CapacityUnits) != want {
+				t.Errorf("%s: got capacity %v, want %v", name, cc, want)
+			}
+		}
+	}
+	query, scan := read(dynamodb.ReturnConsumedCapacityTotal)
+	check("miss", 2.5, query, scan)
+	query, scan = read(dynamodb.ReturnConsumedCapacityTotal)
+	check("hit", 0, query, scan)
+	query, scan = read(dynamodb.ReturnConsumedCapacityIndexes)
+	check("hit with indexes", 0, query, scan)
+	if query.Table == nil || scan.Table == nil {
+		t.Error("hit with indexes: no table capacity")
+	}
+	if query, scan = read(""); query != nil || scan != nil {
+		t.Errorf("hit without asking: got capacity %v and %v", query, scan)
+	}
+	if got := f.count("Query") + f.count("Scan"); got != 2 {
+		t.Errorf("called DynamoDB %d times, want 2", got)
+	}
+}
+
+func TestEmptyResultTTL(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithQueryTTL(time.Hour), WithScanTTL(time.Hour), WithEmptyResultTTL(50*time.Millisecond))
+	f.addTable(testDesc("U"))
+	f.put("T", item("pk", "b", "sk", "1"))
+	read := func() (empty, full, scan int) {
+		t.Helper()
+		for i, input := range []*dynamodb.QueryInput{tableQuery("a"), tableQuery("b")} {
+			out, err := c.QueryWithContext(ctx, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				empty = len(out.Items)
+			} else {
+				full = len(out.Items)
+			}
+		}
+		out, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("U")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return empty, full, len(out.Items)
+	}
+	calls := func() int { return f.count("Query") + f.count("Scan") }
+
+	read()
+	before := calls()
+	read()
+	if got := calls() - before; got != 0 {
+		t.Errorf("called DynamoDB %d times for cached results, want 0", got)
+	}
+	time.Sleep(80 * time.Millisecond)
+	before = calls()
+	read()
+	if got := calls() - before; got != 2 {
+		t.Errorf("called DynamoDB %d times after the empty results expired, want 2", got)
+	}
+
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("U"), Item: item("pk", "a", "sk", "1")}); err != nil {
+		t.Fatal(err)
+	}
+	before = calls()
+	if empty, full, scan := read(); empty != 1 || full != 1 || scan != 1 {
+		t.Errorf("after writes, got %d, %d and %d items, want 1 each", empty, full, scan)
+	}
+	if got := calls() - before; got != 2 {
+		t.Errorf("called DynamoDB %d times after writes to the empty results, want 2", got)
+	}
+}
+
+// TestMixedProjectionBatchGet reads one table whole and another projected in the same batch.
+// Only the whole items go in the item cache.
+func TestMixedProjectionBatchGet(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(testDesc("U"))
+	f.put("T", item("pk", "a", "sk", "1", "v", "x"))
+	f.put("U", item("pk", "a", "sk", "1", "v", "x"))
+	input := &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			"T": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1")}},
+			"U": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1")}, ProjectionExpression: aws.String("pk, sk")},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		out, err := c.BatchGetItemWithContext(ctx, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := out.Responses["T"]; len(got) != 1 || got[0]["v"] == nil {
+			t.Errorf("batch %d: got %v from T, want the whole item", i, got)
+		}
+		if got := out.Responses["U"]; len(got) != 1 || got[0]["v"] != nil || got[0]["pk"] == nil {
+			t.Errorf("batch %d: got %v from U, want the projected item", i, got)
+		}
+	}
+	if n := f.count("BatchGetItem"); n != 1 {
+		t.Errorf("called BatchGetItem %d times, want 1", n)
+	}
+	if _, ok := c.ItemTTL("T", key("a", "1")); !ok {
+		t.Error("whole item not cached")
+	}
+	if _, ok := c.ItemTTL("U", key("a", "1")); ok {
+		t.Error("projected item cached as a whole item")
+	}
+}
+
+// TestBinaryKeys uses a table with a binary hash key, including bytes that aren't valid UTF-8.
+func TestBinaryKeys(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(&dynamodb.TableDescription{TableName: aws.String("Bin"), KeySchema: keySchema("id", "")})
+	binKey := func(id ...byte) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{"id": {B: id}}
+	}
+	get := func(k map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+		t.Helper()
+		out, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("Bin"), Key: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Item
+	}
+	query := func(id ...byte) int {
+		t.Helper()
+		out, err := c.QueryWithContext(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String("Bin"),
+			KeyConditionExpression:    aws.String("id = :id"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": {B: id}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out.Items)
+	}
+
+	it := binKey(0xff, 0xfe, 0x00)
+	it["v"] = &dynamodb.AttributeValue{S: aws.String("x")}
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("Bin"), Item: it}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(binKey(0xff, 0xfe, 0x00)); got["v"] == nil || f.count("GetItem") != 0 {
+		t.Errorf("got %v from %d reads, want the cached item", got, f.count("GetItem"))
+	}
+	if got := get(binKey(0xff, 0xfe, 0x01)); got != nil || f.count("GetItem") != 1 {
+		t.Errorf("got %v from %d reads for a different key, want nothing from 1", got, f.count("GetItem"))
+	}
+	for i := 0; i < 2; i++ {
+		if n := query(0xff, 0xfe, 0x00); n != 1 {
+			t.Errorf("query got %d items, want 1", n)
+		}
+		if n := query(0xff, 0xfe); n != 0 {
+			t.Errorf("query of a prefix got %d items, want 0", n)
+		}
+	}
+	if n := f.count("Query"); n != 2 {
+		t.Errorf("queried DynamoDB %d times, want 2", n)
+	}
+
+	if _, err := c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("Bin"), Key: binKey(0xff, 0xfe, 0x00)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(binKey(0xff, 0xfe, 0x00)); got != nil || f.count("GetItem") != 1 {
+		t.Errorf("got %v from %d reads after deleting, want the cached absence", got, f.count("GetItem"))
+	}
+	if n := query(0xff, 0xfe, 0x00); n != 0 || f.count("Query") != 3 {
+		t.Errorf("query got %d items from %d queries after deleting, want 0 from 3", n, f.count("Query"))
+	}
+}
+
+// TestMixedConsistencyBatchGet reads one table consistently and another eventually in the same batch.
+func TestMixedConsistencyBatchGet(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(testDesc("U"))
+	for _, table := range []string{"T", "U"} {
+		f.put(table, item("pk", "a", "sk", "1", "v", "old"))
+		if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(table), Key: key("a", "1")}); err != nil {
+			t.Fatal(err)
+		}
+		f.put(table, item("pk", "a", "sk", "1", "v", "new"))
+	}
+	var requested []string
+	f.on("BatchGetItem", func(body []byte) (interface{}, error) {
+		var in dynamodb.BatchGetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		for table := range in.RequestItems {
+			requested = append(requested, table)
+		}
+		return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{
+			"T": {f.get("T", key("a", "1"))},
+		}}, nil
+	})
+
+	out, err := c.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			"T": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1")}, ConsistentRead: aws.Bool(true)},
+			"U": {Keys: []map[string]*dynamodb.AttributeValue{key("a", "1")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 1 || requested[0] != "T" {
+		t.Errorf("requested %v from DynamoDB, want just T", requested)
+	}
+	for table, want := range map[string]string{"T": "new", "U": "old"} {
+		if got := out.Responses[table]; len(got) != 1 || aws.StringValue(got[0]["v"].S) != want {
+			t.Errorf("got %v from %s, want v = %s", got, table, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package localcache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// cachedCapacity returns the consumed capacity to report for a read served from the cache,
+// according to the request's ReturnConsumedCapacity: nothing was consumed,
+// but callers who asked for it should still get a ConsumedCapacity back.
+func cachedCapacity(table string, mode *string) *dynamodb.ConsumedCapacity {
+	switch aws.StringValue(mode) {
+	case dynamodb.ReturnConsumedCapacityTotal:
+		return &dynamodb.ConsumedCapacity{
+			TableName:     aws.String(table),
+			CapacityUnits: aws.Float64(0),
+		}
+	case dynamodb.ReturnConsumedCapacityIndexes:
+		return &dynamodb.ConsumedCapacity{
+			TableName:     aws.String(table),
+			CapacityUnits: aws.Float64(0),
+			Table:         &dynamodb.Capacity{CapacityUnits: aws.Float64(0)},
+		}
+	}
+	return nil
+}
+
+// cacheableQuery returns a copy of out to cache, without ConsumedCapacity,
+// which depends on the request rather than the results.
+func cacheableQuery(out *dynamodb.QueryOutput) *dynamodb.QueryOutput {
+	cp := *out
+	cp.ConsumedCapacity = nil
+	return &cp
+}
+
+// cachedQuery returns a copy of a cached output with the consumed capacity input asked for.
+func cachedQuery(out *dynamodb.QueryOutput, input *dynamodb.QueryInput) *dynamodb.QueryOutput {
+	cp := *out
+	cp.ConsumedCapacity = cachedCapacity(*input.TableName, input.ReturnConsumedCapacity)
+	return &cp
+}
+
+// cacheableScan is cacheableQuery for scans.
+func cacheableScan(out *dynamodb.ScanOutput) *dynamodb.ScanOutput {
+	cp := *out
+	cp.ConsumedCapacity = nil
+	return &cp
+}
+
+// cachedScan is cachedQuery for scans.
+func cachedScan(out *dynamodb.ScanOutput, input *dynamodb.ScanInput) *dynamodb.ScanOutput {
+	cp := *out
+	cp.ConsumedCapacity = cachedCapacity(*input.TableName, input.ReturnConsumedCapacity)
+	return &cp
+}
@@ -0,0 +1,289 @@
+package localcache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/karlseguin/ccache"
+)
+
+// defaultDescTTL is how long table descriptions are cached, unless set by WithDescTTL.
+const defaultDescTTL = 24 * time.Hour
+
+// Failures to describe a table because DynamoDB is throttling or failing are cached too,
+// so that callers don't all retry at once while it recovers. Each consecutive failure doubles
+// how long the error is cached, from descBackoffMin up to descBackoffMax; a success resets it.
+const (
+	descBackoffMin = time.Second
+	descBackoffMax = time.Minute
+)
+
+// descFailure is cached in place of a table's description after describing it fails.
+type descFailure struct {
+	err      error
+	failures int
+}
+
+// DescCache holds table descriptions, which the cache needs to know tables' key schemas.
+// It is safe for concurrent use, and can be shared between caches with WithSharedDescCache,
+// so that processes with many caches only describe each table once.
+// Descriptions are keyed by region and endpoint as well as table name, so caches for
+// different regions (or, say, DynamoDB Local) won't mix up tables that share a name.
+type DescCache struct {
+	descs Backend
+}
+
+// NewDescCache creates a description cache with the given ccache configuration,
+// or the default configuration if cfg is nil. See NewDescCacheWithBackend to use another Backend.
+func NewDescCache(cfg *ccache.Configuration) *DescCache {
+	return &DescCache{
+		descs: newCCacheBackend(cfg),
+	}
+}
+
+// NewDescCacheWithBackend creates a description cache that stores descriptions in b.
+func NewDescCacheWithBackend(b Backend) *DescCache {
+	return &DescCache{
+		descs: b,
+	}
+}
+
+func (dc *DescCache) get(region, table string) (*dynamodb.DescribeTableOutput, bool) {
+	item := dc.descs.Get(table, region)
+	if item == nil || item.Expired() {
+		return nil, false
+	}
+	desc, ok := item.Value().(*dynamodb.DescribeTableOutput)
+	return desc, ok
+}
+
+// peek reports whether the description of table is cached, without promoting it.
+func (dc *DescCache) peek(region, table string) bool {
+	item := dc.descs.Peek(table, region)
+	if item == nil || item.Expired() {
+		return false
+	}
+	_, ok := item.Value().(*dynamodb.DescribeTableOutput)
+	return ok
+}
+
+// failure returns the last cached failure to describe table, if any, even if it has expired,
+// and whether it is still in effect.
+func (dc *DescCache) failure(region, table string) (*descFailure, bool) {
+	item := dc.descs.Peek(table, region)
+	if item == nil {
+		return nil, false
+	}
+	f, ok := item.Value().(*descFailure)
+	if !ok {
+		return nil, false
+	}
+	return f, !item.Expired()
+}
+
+func (dc *DescCache) set(region, table string, desc *dynamodb.DescribeTableOutput, ttl time.Duration) {
+	dc.descs.Set(table, region, desc, ttl)
+}
+
+// fail caches err as the result of describing table, backing off from previous failures.
+func (dc *DescCache) fail(region, table string, err error) {
+	f := &descFailure{err: err, failures: 1}
+	if prev, _ := dc.failure(region, table); prev != nil {
+		f.failures = prev.failures + 1
+	}
+	ttl := descBackoffMin
+	for i := 1; i < f.failures && ttl < descBackoffMax; i++ {
+		ttl *= 2
+	}
+	dc.descs.Set(table, region, f, min(ttl, descBackoffMax))
+}
+
+// missingIndex is cached in place of an index's description after a refreshed
+// description of its table still doesn't have it.
+type missingIndex struct{}
+
+// indexMissing reports whether index was recently found to be missing from table.
+func (dc *DescCache) indexMissing(region, table, index string) bool {
+	item := dc.descs.Peek(table, region+"#"+index)
+	if item == nil || item.Expired() {
+		return false
+	}
+	_, ok := item.Value().(missingIndex)
+	return ok
+}
+
+// missIndex caches index as missing from table, so that queries of an index that doesn't exist
+// (yet) don't each describe the table again. It's cached briefly, in case the index is being created.
+func (dc *DescCache) missIndex(region, table, index string) {
+	dc.descs.Set(table, region+"#"+index, missingIndex{}, descBackoffMin)
+}
+
+func (dc *DescCache) delete(region, table string) {
+	dc.descs.Delete(table, region)
+}
+
+// Clear removes every cached description.
+func (dc *DescCache) Clear() {
+	dc.descs.Clear()
+}
+
+// Close stops the description cache's background goroutine.
+// It must not be used after it is closed.
+func (dc *DescCache) Close() error {
+	dc.descs.Stop()
+	return nil
+}
+
+// region identifies where the client's tables live, for keying their descriptions:
+// its region and endpoint, since one region name may be served by several endpoints.
+func (c *Cache) region() string {
+	return aws.StringValue(c.DynamoDB.Config.Region) + " " + c.DynamoDB.Endpoint
+}
+
+func (c *Cache) desc(ctx aws.Context, table string, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if desc, ok := c.tableDesc.get(c.region(), table); ok {
+		return desc, nil
+	}
+	if f, ok := c.tableDesc.failure(c.region(), table); ok {
+		return nil, f.err
+	}
+	out, err := c.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: &table}, opts...)
+	if err != nil {
+		err = fmt.Errorf("localcache: describe %s: %w", table, err)
+		c.recordError(table, err)
+		// a cancelled caller says nothing about DynamoDB, and other errors (such as a
+		// missing table or permission) are for the caller to fix, and retry right after
+		if ctx.Err() == nil && backsOff(err) {
+			c.tableDesc.fail(c.region(), table, err)
+		}
+		return nil, err
+	}
+	if out.Table == nil {
+		// nothing to go on, and nothing worth caching either
+		return nil, fmt.Errorf("localcache: describe %s: missing table description", table)
+	}
+	normalizeKeySchemas(out)
+	c.tableDesc.set(c.region(), table, out, c.descTTL)
+	c.log(LogEntry{Table: table, Msg: "caching desc", TTL: c.descTTL})
+	return out, nil
+}
+
+// backsOff reports whether err means DynamoDB is throttling or failing,
+// so that describing the table again should wait a while.
+func backsOff(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if request.IsErrorThrottle(aerr) {
+		return true
+	}
+	var failure awserr.RequestFailure
+	return errors.As(err, &failure) && failure.StatusCode() >= 500
+}
+
+// normalizeKeySchemas orders every key schema in desc hash key first, range key second.
+// DescribeTable doesn't promise any order, and while key building goes by KeyType
+// (see hashKey), anything else reading a schema can then rely on its order too.
+func normalizeKeySchemas(desc *dynamodb.DescribeTableOutput) {
+	if desc.Table == nil {
+		return
+	}
+	sortKeySchema(desc.Table.KeySchema)
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		sortKeySchema(gsi.KeySchema)
+	}
+	for _, lsi := range desc.Table.LocalSecondaryIndexes {
+		sortKeySchema(lsi.KeySchema)
+	}
+}
+
+func sortKeySchema(schema []*dynamodb.KeySchemaElement) {
+	if len(schema) == 2 && aws.StringValue(schema[1].KeyType) == dynamodb.KeyTypeHash {
+		schema[0], schema[1] = schema[1], schema[0]
+	}
+}
+
+// HasSchema reports whether table's description is cached, such as to check that warming
+// up finished. Unlike CanCache, it never describes the table, nor counts as a use of it.
+func (c *Cache) HasSchema(table string) bool {
+	return c.tableDesc.peek(c.region(), table)
+}
+
+// forgetDesc drops the cached description of table, so the next lookup describes it again.
+func (c *Cache) forgetDesc(table string) {
+	c.tableDesc.delete(c.region(), table)
+}
+
+// CanCache reports whether table's key schema, and those of its indexes, are supported by the cache.
+// It describes the table if necessary, so it can be used at startup to fail fast
+// instead of finding out at the first request.
+// Unsupported schemas are reported with a descriptive error.
+func (c *Cache) CanCache(ctx aws.Context, table string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	desc, err := c.desc(ctx, table)
+	if err != nil {
+		return false, err
+	}
+	if err := validateDesc(table, desc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// validateDesc checks the key schemas of a table and its indexes, see CanCache.
+func validateDesc(table string, desc *dynamodb.DescribeTableOutput) error {
+	if desc.Table == nil {
+		return fmt.Errorf("localcache: table %s: missing table description", table)
+	}
+	if err := validateKeySchema(desc.Table.KeySchema); err != nil {
+		return fmt.Errorf("localcache: table %s: %w", table, err)
+	}
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		if err := validateKeySchema(gsi.KeySchema); err != nil {
+			return fmt.Errorf("localcache: table %s index %s: %w", table, aws.StringValue(gsi.IndexName), err)
+		}
+	}
+	for _, lsi := range desc.Table.LocalSecondaryIndexes {
+		if err := validateKeySchema(lsi.KeySchema); err != nil {
+			return fmt.Errorf("localcache: table %s index %s: %w", table, aws.StringValue(lsi.IndexName), err)
+		}
+	}
+	return nil
+}
+
+// validateKeySchema checks that schema is a hash key, optionally with a range key,
+// which is what key building expects. They may be listed in either order.
+func validateKeySchema(schema []*dynamodb.KeySchemaElement) error {
+	if len(schema) == 0 {
+		return fmt.Errorf("unsupported key schema: no key attributes")
+	}
+	if len(schema) > 2 {
+		return fmt.Errorf("unsupported key schema: %d key attributes", len(schema))
+	}
+	seen := make(map[string]bool, len(schema))
+	for _, elem := range schema {
+		if elem == nil || aws.StringValue(elem.AttributeName) == "" {
+			return fmt.Errorf("unsupported key schema: missing attribute name")
+		}
+		kt := aws.StringValue(elem.KeyType)
+		if kt != dynamodb.KeyTypeHash && kt != dynamodb.KeyTypeRange {
+			return fmt.Errorf("unsupported key schema: %s has key type %q", *elem.AttributeName, kt)
+		}
+		if seen[kt] {
+			return fmt.Errorf("unsupported key schema: more than one %s key", kt)
+		}
+		seen[kt] = true
+	}
+	if !seen[dynamodb.KeyTypeHash] {
+		return fmt.Errorf("unsupported key schema: no HASH key")
+	}
+	return nil
+}
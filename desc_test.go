@@ -0,0 +1,233 @@
+package localcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func indexQuery(index, g string) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		TableName:              aws.String("T"),
+		IndexName:              aws.String(index),
+		KeyConditionExpression: aws.String("g = :g"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":g": {S: aws.String(g)},
+		},
+	}
+}
+
+func TestSchemaOfNewIndex(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	if _, err := c.CanCache(ctx, "T"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is created after the table was described
+	desc := testDesc("T")
+	desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+		IndexName:  aws.String("new"),
+		KeySchema:  keySchema("g", ""),
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+	})
+	f.addTable(desc)
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+
+	for i := 0; i < 2; i++ {
+		out, err := c.QueryWithContext(ctx, indexQuery("new", "x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Items) != 1 {
+			t.Fatalf("got %d items, want 1", len(out.Items))
+		}
+	}
+	if got := f.count("DescribeTable"); got != 2 {
+		t.Errorf("DescribeTable called %d times, want 2", got)
+	}
+	if got := f.count("Query"); got != 1 {
+		t.Errorf("Query called %d times, want 1", got)
+	}
+}
+
+func TestSchemaOfMissingIndex(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	for i := 0; i < 3; i++ {
+		if _, err := c.QueryWithContext(ctx, indexQuery("typo", "x")); err == nil {
+			t.Fatal("query of missing index succeeded")
+		}
+	}
+	// once at first, and once more to check whether the index is new
+	if got := f.count("DescribeTable"); got != 2 {
+		t.Errorf("DescribeTable called %d times, want 2", got)
+	}
+	if got := f.count("Query"); got != 3 {
+		t.Errorf("Query called %d times, want 3", got)
+	}
+}
+
+func TestDescribeWithRequestOptions(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	withHeader := func(r *request.Request) {
+		r.HTTPRequest.Header.Set("X-Test", "yes")
+	}
+	_, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")}, withHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.count("DescribeTable") != 1 {
+		t.Fatalf("described the table %d times", f.count("DescribeTable"))
+	}
+	if got := f.header("DescribeTable").Get("X-Test"); got != "yes" {
+		t.Errorf("DescribeTable header X-Test = %q, want yes", got)
+	}
+}
+
+func TestDescTTL(t *testing.T) {
+	ctx := context.Background()
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		c, f := newTestCache(t, WithDescTTL(ttl))
+		for i := 0; i < 2; i++ {
+			if _, err := c.CanCache(ctx, "T"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := f.count("DescribeTable"); got != 1 {
+			t.Errorf("WithDescTTL(%v): described the table %d times, want 1", ttl, got)
+		}
+	}
+}
+
+func TestDescBackoff(t *testing.T) {
+	dc := NewDescCache(nil)
+	defer dc.Close()
+	err := awserr.NewRequestFailure(awserr.New("ThrottlingException", "slow down", nil), 400, "")
+	ttl := func() time.Duration {
+		return dc.descs.Peek("T", "r").TTL()
+	}
+
+	var last time.Duration
+	for i := 0; i < 10; i++ {
+		dc.fail("r", "T", err)
+		got := ttl()
+		if got > descBackoffMax {
+			t.Fatalf("failure %d: backed off for %v, more than the max", i+1, got)
+		}
+		if got <= last && last < descBackoffMax-time.Second {
+			t.Fatalf("failure %d: backed off for %v, after %v", i+1, got, last)
+		}
+		last = got
+	}
+	if last < descBackoffMax-time.Second {
+		t.Errorf("backed off for %v after 10 failures, want about %v", last, descBackoffMax)
+	}
+
+	dc.set("r", "T", &dynamodb.DescribeTableOutput{Table: testDesc("T")}, time.Hour)
+	dc.fail("r", "T", err)
+	if got := ttl(); got > descBackoffMin {
+		t.Errorf("backed off for %v after a success, want %v", got, descBackoffMin)
+	}
+}
+
+func TestDescErrorCaching(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		err   fakeErr
+		calls int
+	}{
+		{errThrottled, 1},
+		{errInternal, 1},
+		{errAccessDenied, 2},
+		{errNotFound, 2},
+	}
+	for _, test := range tests {
+		c, f := newTestCache(t)
+		f.on("DescribeTable", func([]byte) (interface{}, error) {
+			return nil, test.err
+		})
+		for i := 0; i < 2; i++ {
+			if _, err := c.CanCache(ctx, "T"); err == nil {
+				t.Fatalf("%s: CanCache succeeded", test.err.code)
+			}
+		}
+		if got := f.count("DescribeTable"); got != test.calls {
+			t.Errorf("%s: described the table %d times, want %d", test.err.code, got, test.calls)
+		}
+	}
+}
+
+// TestRegions has tables of the same name in two regions, with different keys.
+func TestRegions(t *testing.T) {
+	ctx := context.Background()
+	shared := NewDescCache(nil)
+	defer shared.Close()
+
+	east, west := newFakeDynamo(), newFakeDynamo()
+	west.addTable(&dynamodb.TableDescription{TableName: aws.String("T"), KeySchema: keySchema("pk", "")})
+	east.put("T", item("pk", "a", "sk", "1", "v", "east"))
+	west.put("T", item("pk", "a", "v", "west"))
+	cEast := NewWithDB(east.client("us-east-1"), WithSharedDescCache(shared))
+	defer cEast.Close()
+	cWest := NewWithDB(west.client("us-west-2"), WithSharedDescCache(shared))
+	defer cWest.Close()
+
+	for i := 0; i < 2; i++ {
+		out, err := cEast.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aws.StringValue(out.Item["v"].S); got != "east" {
+			t.Errorf("got %q from us-east-1", got)
+		}
+		out, err = cWest.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: item("pk", "a")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := aws.StringValue(out.Item["v"].S); got != "west" {
+			t.Errorf("got %q from us-west-2", got)
+		}
+	}
+	for _, f := range []*fakeDynamo{east, west} {
+		if f.count("DescribeTable") != 1 || f.count("GetItem") != 1 {
+			t.Errorf("described %d times and got %d times, want once each", f.count("DescribeTable"), f.count("GetItem"))
+		}
+	}
+}
+
+// TestEmptyKeySchema describes a table without a key schema, which the cache can't key items of.
+func TestEmptyKeySchema(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(&dynamodb.TableDescription{TableName: aws.String("E")})
+	f.put("E", item("pk", "a"))
+
+	if ok, err := c.CanCache(ctx, "E"); ok || err == nil {
+		t.Errorf("CanCache() = %v, %v", ok, err)
+	}
+	for i := 0; i < 2; i++ {
+		out, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("E"), Key: item("pk", "a")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Item == nil {
+			t.Error("GetItem didn't pass through")
+		}
+		if _, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("E")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.count("GetItem") != 2 || f.count("Scan") != 2 {
+		t.Errorf("got %d times and scanned %d times, want twice each", f.count("GetItem"), f.count("Scan"))
+	}
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("E"), Item: item("pk", "b")}); err == nil {
+		t.Error("PutItem succeeded without knowing what to invalidate")
+	}
+}
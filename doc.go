@@ -0,0 +1,32 @@
+// Package localcache wraps a DynamoDB client with an in-memory cache.
+//
+// Cache embeds *dynamodb.DynamoDB, so any method it doesn't override goes
+// straight to DynamoDB, uncached. Take care when upgrading the SDK: new methods
+// will silently pass through.
+//
+// These methods read from the cache:
+//   - GetItemWithContext
+//   - BatchGetItemWithContext
+//   - QueryWithContext
+//   - ScanWithContext
+//   - ExecuteStatementWithContext, for PartiQL SELECT statements
+//
+// These methods write to DynamoDB and update or invalidate the cache:
+//   - PutItemWithContext
+//   - UpdateItemWithContext
+//   - DeleteItemWithContext
+//   - BatchWriteItemWithContext
+//   - TransactWriteItemsWithContext
+//   - ExecuteStatementWithContext, for other PartiQL statements, which
+//     invalidate everything cached for their table
+//
+// Everything else passes through, including the variants without a context
+// (such as GetItem), the Request variants (such as GetItemRequest), and the
+// Pages variants (such as QueryPagesWithContext), as well as PartiQL batches and
+// transactions (BatchExecuteStatement and ExecuteTransaction). Writes made through
+// them will not invalidate the cache.
+package localcache
+
+import "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+
+var _ dynamodbiface.DynamoDBAPI = (*Cache)(nil)
@@ -0,0 +1,102 @@
+package localcache
+
+import (
+	"go/ast"
+	"go/parser"
+	gotoken "go/token"
+	"io/fs"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// cachedMethods are the methods of dynamodbiface.DynamoDBAPI that Cache overrides,
+// as listed in the package documentation.
+var cachedMethods = []string{
+	"GetItemWithContext",
+	"BatchGetItemWithContext",
+	"QueryWithContext",
+	"ScanWithContext",
+	"ExecuteStatementWithContext",
+	"PutItemWithContext",
+	"UpdateItemWithContext",
+	"DeleteItemWithContext",
+	"BatchWriteItemWithContext",
+	"TransactWriteItemsWithContext",
+}
+
+// knownOperations are the DynamoDB operations as of the SDK version in go.mod.
+// Besides the cached methods above, they all pass through.
+var knownOperations = map[string]bool{
+	"BatchExecuteStatement": true, "BatchGetItem": true, "BatchWriteItem": true,
+	"CreateBackup": true, "CreateGlobalTable": true, "CreateTable": true,
+	"DeleteBackup": true, "DeleteItem": true, "DeleteResourcePolicy": true, "DeleteTable": true,
+	"DescribeBackup": true, "DescribeContinuousBackups": true, "DescribeContributorInsights": true,
+	"DescribeEndpoints": true, "DescribeExport": true, "DescribeGlobalTable": true,
+	"DescribeGlobalTableSettings": true, "DescribeImport": true, "DescribeKinesisStreamingDestination": true,
+	"DescribeLimits": true, "DescribeTable": true, "DescribeTableReplicaAutoScaling": true,
+	"DescribeTimeToLive": true, "DisableKinesisStreamingDestination": true,
+	"EnableKinesisStreamingDestination": true, "ExecuteStatement": true, "ExecuteTransaction": true,
+	"ExportTableToPointInTime": true, "GetItem": true, "GetResourcePolicy": true, "ImportTable": true,
+	"ListBackups": true, "ListContributorInsights": true, "ListExports": true, "ListGlobalTables": true,
+	"ListImports": true, "ListTables": true, "ListTagsOfResource": true, "PutItem": true,
+	"PutResourcePolicy": true, "Query": true, "RestoreTableFromBackup": true,
+	"RestoreTableToPointInTime": true, "Scan": true, "TagResource": true, "TransactGetItems": true,
+	"TransactWriteItems": true, "UntagResource": true, "UpdateContinuousBackups": true,
+	"UpdateContributorInsights": true, "UpdateGlobalTable": true, "UpdateGlobalTableSettings": true,
+	"UpdateItem": true, "UpdateKinesisStreamingDestination": true, "UpdateTable": true,
+	"UpdateTableReplicaAutoScaling": true, "UpdateTimeToLive": true,
+	"WaitUntilTableExists": true, "WaitUntilTableNotExists": true,
+}
+
+var methodVariant = regexp.MustCompile(`(PagesWithContext|WithContext|Pages|Request)$`)
+
+// TestNoNewOperations fails when an SDK upgrade adds operations, which would silently
+// pass through the cache. Decide whether each needs caching or invalidation,
+// then add it to knownOperations and the package documentation.
+func TestNoNewOperations(t *testing.T) {
+	api := reflect.TypeOf((*dynamodbiface.DynamoDBAPI)(nil)).Elem()
+	for i := 0; i < api.NumMethod(); i++ {
+		name := api.Method(i).Name
+		if op := methodVariant.ReplaceAllString(name, ""); !knownOperations[op] {
+			t.Errorf("new DynamoDB method %s passes through the cache", name)
+		}
+	}
+}
+
+// TestCachedMethods checks that Cache itself declares each cached method,
+// rather than inheriting it from the embedded client.
+func TestCachedMethods(t *testing.T) {
+	pkgs, err := parser.ParseDir(gotoken.NewFileSet(), ".", func(fi fs.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, parser.SkipObjectResolution)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := make(map[string]bool)
+	for _, file := range pkgs["localcache"].Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil {
+				continue
+			}
+			if star, ok := fn.Recv.List[0].Type.(*ast.StarExpr); ok {
+				if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "Cache" {
+					declared[fn.Name.Name] = true
+				}
+			}
+		}
+	}
+	api := reflect.TypeOf((*dynamodbiface.DynamoDBAPI)(nil)).Elem()
+	for _, name := range cachedMethods {
+		if _, ok := api.MethodByName(name); !ok {
+			t.Errorf("%s is no longer part of the DynamoDB API", name)
+		}
+		if !declared[name] {
+			t.Errorf("%s isn't declared by Cache, so it passes through uncached", name)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package localcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeDynamo is an in-memory DynamoDB, just enough of one to test the cache against.
+// It serves the SDK's requests as an http.RoundTripper, so they never leave the process.
+// Reads return whole items: projections and filters are ignored.
+type fakeDynamo struct {
+	mu      sync.Mutex
+	tables  map[string]*fakeTable
+	calls   map[string]int
+	headers map[string]http.Header
+	hooks   map[string]func(body []byte) (interface{}, error)
+}
+
+type fakeTable struct {
+	desc  *dynamodb.TableDescription
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+// fakeErr is returned by hooks to respond with a DynamoDB error.
+type fakeErr struct {
+	status int
+	code   string
+}
+
+func (e fakeErr) Error() string {
+	return e.code
+}
+
+var (
+	errThrottled    = fakeErr{400, "ThrottlingException"}
+	errAccessDenied = fakeErr{400, "AccessDeniedException"}
+	errNotFound     = fakeErr{400, "ResourceNotFoundException"}
+	errValidation   = fakeErr{400, "ValidationException"}
+	errInternal     = fakeErr{500, "InternalServerError"}
+	errCondition    = fakeErr{400, "ConditionalCheckFailedException"}
+)
+
+// newFakeDynamo returns a fake with the table described by testDesc("T").
+func newFakeDynamo() *fakeDynamo {
+	f := &fakeDynamo{
+		tables:  make(map[string]*fakeTable),
+		calls:   make(map[string]int),
+		headers: make(map[string]http.Header),
+		hooks:   make(map[string]func([]byte) (interface{}, error)),
+	}
+	f.addTable(testDesc("T"))
+	return f
+}
+
+// newTestCache returns a cache in front of a new fake, closed when the test ends.
+func newTestCache(tb testing.TB, opts ...Option) (*Cache, *fakeDynamo) {
+	f := newFakeDynamo()
+	c := NewWithDB(f.client("us-east-1"), opts...)
+	tb.Cleanup(func() { c.Close() })
+	return c, f
+}
+
+// testDesc describes a table keyed by pk and sk, with a global secondary index "gsi"
+// keyed by g and sk projecting everything, and one named "keys" keyed by g alone
+// projecting only keys.
+func testDesc(name string) *dynamodb.TableDescription {
+	return &dynamodb.TableDescription{
+		TableName: aws.String(name),
+		KeySchema: keySchema("pk", "sk"),
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{
+			{
+				IndexName:  aws.String("gsi"),
+				KeySchema:  keySchema("g", "sk"),
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			},
+			{
+				IndexName:  aws.String("keys"),
+				KeySchema:  keySchema("g", ""),
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+			},
+		},
+	}
+}
+
+// reversedDesc is testDesc, but with every key schema listing the range key first,
+// which DescribeTable is free to do.
+func reversedDesc(name string) *dynamodb.TableDescription {
+	desc := testDesc(name)
+	reverse := func(schema []*dynamodb.KeySchemaElement) {
+		for i, j := 0, len(schema)-1; i < j; i, j = i+1, j-1 {
+			schema[i], schema[j] = schema[j], schema[i]
+		}
+	}
+	reverse(desc.KeySchema)
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		reverse(gsi.KeySchema)
+	}
+	return desc
+}
+
+func keySchema(hk, rk string) []*dynamodb.KeySchemaElement {
+	schema := []*dynamodb.KeySchemaElement{{AttributeName: aws.String(hk), KeyType: aws.String(dynamodb.KeyTypeHash)}}
+	if rk != "" {
+		schema = append(schema, &dynamodb.KeySchemaElement{AttributeName: aws.String(rk), KeyType: aws.String(dynamodb.KeyTypeRange)})
+	}
+	return schema
+}
+
+// item makes an item of string attributes out of name, value pairs.
+func item(kv ...string) map[string]*dynamodb.AttributeValue {
+	item := make(map[string]*dynamodb.AttributeValue, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		item[kv[i]] = &dynamodb.AttributeValue{S: aws.String(kv[i+1])}
+	}
+	return item
+}
+
+// project applies a projection expression of top-level attributes to item.
+func project(item map[string]*dynamodb.AttributeValue, expr *string, names map[string]*string) map[string]*dynamodb.AttributeValue {
+	if item == nil || expr == nil {
+		return item
+	}
+	projected := make(map[string]*dynamodb.AttributeValue)
+	for _, name := range strings.Split(*expr, ",") {
+		name = strings.TrimSpace(name)
+		if sub, ok := names[name]; ok {
+			name = *sub
+		}
+		if av, ok := item[name]; ok {
+			projected[name] = av
+		}
+	}
+	return projected
+}
+
+// key returns the key of an item in T.
+func key(pk, sk string) map[string]*dynamodb.AttributeValue {
+	return item("pk", pk, "sk", sk)
+}
+
+func (f *fakeDynamo) client(region string) *dynamodb.DynamoDB {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String(region),
+		Endpoint:    aws.String("http://dynamodb.test"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	// set apart from the session, which insists on an *http.Transport if AWS_CA_BUNDLE is set
+	return dynamodb.New(sess, &aws.Config{HTTPClient: &http.Client{Transport: f}})
+}
+
+func (f *fakeDynamo) addTable(desc *dynamodb.TableDescription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[*desc.TableName] = &fakeTable{desc: desc, items: make(map[string]map[string]*dynamodb.AttributeValue)}
+}
+
+// on overrides op with fn, which is given the request body and returns the output or a fakeErr.
+func (f *fakeDynamo) on(op string, fn func(body []byte) (interface{}, error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hooks[op] = fn
+}
+
+// count returns how many times op was called.
+func (f *fakeDynamo) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// header returns the headers of the last call to op.
+func (f *fakeDynamo) header(op string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers[op]
+}
+
+// put writes an item directly, as if by someone not using the cache.
+func (f *fakeDynamo) put(table string, item map[string]*dynamodb.AttributeValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.tables[table]
+	t.items[t.key(item)] = item
+}
+
+// get reads an item directly.
+func (f *fakeDynamo) get(table string, key map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := f.tables[table]
+	return t.items[t.key(key)]
+}
+
+func (f *fakeDynamo) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.calls[op]++
+	f.headers[op] = req.Header.Clone()
+	hook := f.hooks[op]
+	f.mu.Unlock()
+
+	var out interface{}
+	if hook != nil {
+		out, err = hook(body)
+	} else {
+		out, err = f.serve(op, body)
+	}
+	status := http.StatusOK
+	var resp []byte
+	if err != nil {
+		ferr, ok := err.(fakeErr)
+		if !ok {
+			ferr = fakeErr{500, "InternalServerError"}
+		}
+		status = ferr.status
+		resp = []byte(fmt.Sprintf(`{"__type":"com.amazonaws.dynamodb.v20120810#%s","message":%q}`, ferr.code, err.Error()))
+	} else if resp, err = jsonutil.BuildJSON(out); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(bytes.NewReader(resp)),
+		Request:    req,
+	}, nil
+}
+
+func decode(body []byte, v interface{}) error {
+	if err := jsonutil.UnmarshalJSON(v, bytes.NewReader(body)); err != nil {
+		return fakeErr{400, "SerializationException"}
+	}
+	return nil
+}
+
+func (f *fakeDynamo) serve(op string, body []byte) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch op {
+	case "DescribeTable":
+		var in dynamodb.DescribeTableInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamodb.DescribeTableOutput{Table: t.desc}, nil
+	case "GetItem":
+		var in dynamodb.GetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return &dynamodb.GetItemOutput{Item: project(t.items[t.key(in.Key)], in.ProjectionExpression, in.ExpressionAttributeNames)}, nil
+	case "PutItem":
+		var in dynamodb.PutItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		old := t.write(in.Item, in.Item)
+		return &dynamodb.PutItemOutput{Attributes: returned(in.ReturnValues, old, nil)}, nil
+	case "DeleteItem":
+		var in dynamodb.DeleteItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		old := t.write(in.Key, nil)
+		return &dynamodb.DeleteItemOutput{Attributes: returned(in.ReturnValues, old, nil)}, nil
+	case "UpdateItem":
+		var in dynamodb.UpdateItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		old, updated := t.update(in.Key, in.UpdateExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+		return &dynamodb.UpdateItemOutput{Attributes: returned(in.ReturnValues, old, updated)}, nil
+	case "BatchGetItem":
+		var in dynamodb.BatchGetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		out := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]*dynamodb.AttributeValue)}
+		for name, kas := range in.RequestItems {
+			t, err := f.table(&name)
+			if err != nil {
+				return nil, err
+			}
+			out.Responses[name] = []map[string]*dynamodb.AttributeValue{}
+			for _, k := range kas.Keys {
+				if item := t.items[t.key(k)]; item != nil {
+					out.Responses[name] = append(out.Responses[name], project(item, kas.ProjectionExpression, kas.ExpressionAttributeNames))
+				}
+			}
+		}
+		return out, nil
+	case "BatchWriteItem":
+		var in dynamodb.BatchWriteItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		for name, reqs := range in.RequestItems {
+			t, err := f.table(&name)
+			if err != nil {
+				return nil, err
+			}
+			for _, req := range reqs {
+				if req.PutRequest != nil {
+					t.write(req.PutRequest.Item, req.PutRequest.Item)
+				}
+				if req.DeleteRequest != nil {
+					t.write(req.DeleteRequest.Key, nil)
+				}
+			}
+		}
+		return &dynamodb.BatchWriteItemOutput{}, nil
+	case "TransactWriteItems":
+		var in dynamodb.TransactWriteItemsInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		for _, ti := range in.TransactItems {
+			switch {
+			case ti.Put != nil:
+				t, err := f.table(ti.Put.TableName)
+				if err != nil {
+					return nil, err
+				}
+				t.write(ti.Put.Item, ti.Put.Item)
+			case ti.Delete != nil:
+				t, err := f.table(ti.Delete.TableName)
+				if err != nil {
+					return nil, err
+				}
+				t.write(ti.Delete.Key, nil)
+			case ti.Update != nil:
+				t, err := f.table(ti.Update.TableName)
+				if err != nil {
+					return nil, err
+				}
+				t.update(ti.Update.Key, ti.Update.UpdateExpression, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues)
+			}
+		}
+		return &dynamodb.TransactWriteItemsOutput{}, nil
+	case "Query":
+		var in dynamodb.QueryInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return t.query(&in)
+	case "Scan":
+		var in dynamodb.ScanInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		t, err := f.table(in.TableName)
+		if err != nil {
+			return nil, err
+		}
+		out := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+		for _, k := range t.keys() {
+			out.Items = append(out.Items, t.items[k])
+		}
+		out.Count = aws.Int64(int64(len(out.Items)))
+		if aws.StringValue(in.Select) == dynamodb.SelectCount {
+			out.Items = nil
+		}
+		return out, nil
+	}
+	return nil, fakeErr{400, "UnknownOperationException"}
+}
+
+func (f *fakeDynamo) table(name *string) (*fakeTable, error) {
+	t, ok := f.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, errNotFound
+	}
+	return t, nil
+}
+
+func (t *fakeTable) key(item map[string]*dynamodb.AttributeValue) string {
+	var key strings.Builder
+	for _, elem := range t.desc.KeySchema {
+		if av := item[*elem.AttributeName]; av != nil {
+			key.WriteString(avString(av))
+		}
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+func (t *fakeTable) keys() []string {
+	keys := make([]string, 0, len(t.items))
+	for k := range t.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write replaces the item with the given key by item, or deletes it if item is nil,
+// and returns the old item.
+func (t *fakeTable) write(key, item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	k := t.key(key)
+	old := t.items[k]
+	if item == nil {
+		delete(t.items, k)
+	} else {
+		t.items[k] = item
+	}
+	return old
+}
+
+// update applies an update expression made of SET clauses assigning values,
+// and returns the old item and the updated attributes.
+func (t *fakeTable) update(key map[string]*dynamodb.AttributeValue, expr *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (old, updated map[string]*dynamodb.AttributeValue) {
+	k := t.key(key)
+	old = t.items[k]
+	item := overlay(old, key)
+	updated = make(map[string]*dynamodb.AttributeValue)
+	for _, set := range strings.Split(strings.TrimPrefix(strings.TrimSpace(aws.StringValue(expr)), "SET "), ",") {
+		name, value, ok := strings.Cut(set, "=")
+		if !ok {
+			continue
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if n, ok := names[name]; ok {
+			name = *n
+		}
+		item[name] = values[value]
+		updated[name] = values[value]
+	}
+	t.items[k] = item
+	return old, updated
+}
+
+func returned(mode *string, old, updated map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	switch aws.StringValue(mode) {
+	case dynamodb.ReturnValueAllOld:
+		return old
+	case dynamodb.ReturnValueUpdatedOld:
+		prev := make(map[string]*dynamodb.AttributeValue)
+		for name := range updated {
+			if v, ok := old[name]; ok {
+				prev[name] = v
+			}
+		}
+		return prev
+	case dynamodb.ReturnValueUpdatedNew:
+		return updated
+	case dynamodb.ReturnValueAllNew:
+		return overlay(old, updated)
+	}
+	return nil
+}
+
+// query returns the items matching a query's hash key condition, and its range key
+// condition if it's an equality or begins_with. Queries of KEYS_ONLY indexes return
+// only the table and index keys.
+func (t *fakeTable) query(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	schema := t.desc.KeySchema
+	keysOnly := false
+	if in.IndexName != nil {
+		found := false
+		for _, gsi := range t.desc.GlobalSecondaryIndexes {
+			if *gsi.IndexName == *in.IndexName {
+				schema, found = gsi.KeySchema, true
+				keysOnly = aws.StringValue(gsi.Projection.ProjectionType) == dynamodb.ProjectionTypeKeysOnly
+			}
+		}
+		if !found {
+			return nil, errValidation
+		}
+		if aws.BoolValue(in.ConsistentRead) {
+			return nil, errValidation
+		}
+	}
+	conds := in.KeyConditions
+	if in.KeyConditionExpression != nil {
+		var err error
+		if conds, err = parseKeyCondition(*in.KeyConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues); err != nil {
+			return nil, errValidation
+		}
+	}
+	out := &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+	for _, k := range t.keys() {
+		item := t.items[k]
+		if !matches(item, conds) {
+			continue
+		}
+		if _, ok := item[hashKey(schema)]; !ok {
+			continue
+		}
+		if keysOnly {
+			item = keyOf(item, append(append([]*dynamodb.KeySchemaElement{}, t.desc.KeySchema...), schema...))
+		}
+		out.Items = append(out.Items, item)
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	if aws.StringValue(in.Select) == dynamodb.SelectCount {
+		out.Items = nil
+	}
+	return out, nil
+}
+
+func matches(item map[string]*dynamodb.AttributeValue, conds map[string]*dynamodb.Condition) bool {
+	for name, cond := range conds {
+		v := item[name]
+		if v == nil {
+			return false
+		}
+		got, want := avString(v), avString(cond.AttributeValueList[0])
+		switch aws.StringValue(cond.ComparisonOperator) {
+		case dynamodb.ComparisonOperatorEq:
+			if got != want {
+				return false
+			}
+		case dynamodb.ComparisonOperatorBeginsWith:
+			if !strings.HasPrefix(got, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func avString(v *dynamodb.AttributeValue) string {
+	switch {
+	case v.S != nil:
+		return *v.S
+	case v.N != nil:
+		return *v.N
+	case v.B != nil:
+		return string(v.B)
+	}
+	return v.String()
+}
+
+// num makes a number attribute.
+func num(n int) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(n))}
+}
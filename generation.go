@@ -0,0 +1,84 @@
+package localcache
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// genStripes is the number of stripes item keys are spread over.
+// Keys sharing a stripe only cost each other the occasional skipped fill.
+const genStripes = 1024
+
+// generations orders cache fills after reads against writes of the same items.
+//
+// A read that misses the cache fetches the item and then caches it, but a write can land
+// in between: the read then caches the old item on top of the write's update or
+// invalidation. To prevent that, every write to an item's cache entry bumps the
+// generation of the item's stripe, and reads note the generation before fetching
+// and only fill the cache if it's unchanged. Both happen under the stripe's lock,
+// so a fill can't slip in between a write's check and its update.
+type generations [genStripes]genStripe
+
+type genStripe struct {
+	mu  sync.Mutex
+	gen uint64
+}
+
+func (g *generations) stripe(key string) *genStripe {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &g[h.Sum32()%genStripes]
+}
+
+// generation is what a read notes before fetching an item: the generation of the item's
+// stripe, and the epoch of its table, which statements that write to unknown items bump
+// (see invalidateTable).
+type generation struct {
+	stripe uint64
+	epoch  uint64
+}
+
+// itemGen returns the current generation of key in table, to pass to fillItem or
+// fillProjection once the read started after calling it completes.
+func (c *Cache) itemGen(table, key string) generation {
+	s := c.gens.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return generation{stripe: s.gen, epoch: c.epoch(table)}
+}
+
+// fillItem caches the result of a read, unless the item was written since gen.
+// Table-wide writes drop cached items without taking the stripe locks, so the table's
+// epoch is checked again after caching, in case one landed in between.
+func (c *Cache) fillItem(ctx aws.Context, op itemOp, table, key string, v interface{}, gen generation) {
+	s := c.gens.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != gen.stripe || c.epoch(table) != gen.epoch {
+		c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: "not caching, written since read"})
+		return
+	}
+	c.storeItem(ctx, op, table, key, v)
+	if c.epoch(table) != gen.epoch {
+		c.log(LogEntry{Op: op.name, Table: table, Key: key, Msg: "uncaching, table written while caching"})
+		c.removeItem(table, key)
+	}
+}
+
+// fillProjection is fillItem for projected reads.
+func (c *Cache) fillProjection(ctx aws.Context, op, table, key, proj string, v interface{}, gen generation) {
+	s := c.gens.stripe(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != gen.stripe || c.epoch(table) != gen.epoch {
+		c.log(LogEntry{Op: op, Table: table, Key: key, Msg: "not caching projection, written since read", Args: []interface{}{proj}})
+		return
+	}
+	c.storeProjection(ctx, op, table, key, proj, v)
+	if c.epoch(table) != gen.epoch {
+		c.log(LogEntry{Op: op, Table: table, Key: key, Msg: "uncaching projection, table written while caching", Args: []interface{}{proj}})
+		c.projections.Delete(c.projectionLayer(table, key), c.cacheKey(proj))
+	}
+}
@@ -0,0 +1,164 @@
+package localcache
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TestFillAfterWrite has a GetItem read the old item, then a PutItem land
+// before the GetItem caches what it read.
+func TestFillAfterWrite(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1", "v", "old"))
+	if _, err := c.CanCache(ctx, "T"); err != nil {
+		t.Fatal(err)
+	}
+
+	read, proceed := make(chan struct{}), make(chan struct{})
+	f.on("GetItem", func(body []byte) (interface{}, error) {
+		var in dynamodb.GetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		out := &dynamodb.GetItemOutput{Item: f.get("T", in.Key)}
+		close(read)
+		<-proceed
+		return out, nil
+	})
+	done := make(chan map[string]*dynamodb.AttributeValue)
+	go func() {
+		out, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- out.Item
+	}()
+	<-read
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "1", "v", "new")}); err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+	if got := aws.StringValue((<-done)["v"].S); got != "old" {
+		t.Fatalf("racing GetItem got %q, want old", got)
+	}
+
+	f.on("GetItem", nil)
+	if got := aws.StringValue(getItem(t, c, key("a", "1"))["v"].S); got != "new" {
+		t.Errorf("cached %q after the write, want new", got)
+	}
+}
+
+// TestFillAfterStatement is TestFillAfterWrite with a PartiQL write, which drops the whole table.
+func TestFillAfterStatement(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1", "v", "old"))
+	if _, err := c.CanCache(ctx, "T"); err != nil {
+		t.Fatal(err)
+	}
+
+	read, proceed := make(chan struct{}), make(chan struct{})
+	f.on("GetItem", func(body []byte) (interface{}, error) {
+		var in dynamodb.GetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		out := &dynamodb.GetItemOutput{Item: f.get("T", in.Key)}
+		close(read)
+		<-proceed
+		return out, nil
+	})
+	f.on("ExecuteStatement", func([]byte) (interface{}, error) {
+		f.put("T", item("pk", "a", "sk", "1", "v", "new"))
+		return &dynamodb.ExecuteStatementOutput{}, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")}); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-read
+	_, err := c.ExecuteStatementWithContext(ctx, &dynamodb.ExecuteStatementInput{Statement: aws.String(`UPDATE "T" SET v = 'new' WHERE pk = 'a' AND sk = '1'`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+	<-done
+
+	f.on("GetItem", nil)
+	if got := aws.StringValue(getItem(t, c, key("a", "1"))["v"].S); got != "new" {
+		t.Errorf("cached %q after the statement, want new", got)
+	}
+}
+
+// TestFillWriteStress races reads that miss the cache with writes of the same item. Run it with -race.
+// After each round, the cache must agree with DynamoDB.
+func TestFillWriteStress(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	if _, err := c.CanCache(ctx, "T"); err != nil {
+		t.Fatal(err)
+	}
+	// hold each read a little, so writes land between the read and the fill
+	f.on("GetItem", func(body []byte) (interface{}, error) {
+		var in dynamodb.GetItemInput
+		if err := decode(body, &in); err != nil {
+			return nil, err
+		}
+		out := &dynamodb.GetItemOutput{Item: f.get("T", in.Key)}
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+		return out, nil
+	})
+	ik := itemKey("T", key("a", "1"), keySchema("pk", "sk"))
+	for i := 0; i < 500; i++ {
+		// as if evicted, so that the reads miss
+		c.removeItem("T", ik)
+
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		time.Sleep(time.Duration(rand.Intn(250)) * time.Microsecond)
+		var err error
+		switch {
+		case i%10 == 9:
+			_, err = c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("T"), Key: key("a", "1")})
+		case i%2 == 0:
+			_, err = c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "1", "v", strconv.Itoa(i))})
+		default:
+			_, err = c.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+				TableName:                 aws.String("T"),
+				Key:                       key("a", "1"),
+				UpdateExpression:          aws.String("SET v = :v"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String(strconv.Itoa(i))}},
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Wait()
+
+		want := f.get("T", key("a", "1"))
+		got := getItem(t, c, key("a", "1"))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round %d: cached %v, but DynamoDB has %v", i, got, want)
+		}
+	}
+}
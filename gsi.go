@@ -0,0 +1,125 @@
+package localcache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The GSI item cache holds items as returned by global secondary index queries.
+// These only have the index's projected attributes, so they must never be served
+// as full items: they are kept apart from the main item cache and only serve
+// lookups scoped to the same index.
+//
+// Entries are keyed by the index key plus the table's primary key, because
+// index keys aren't unique. Any write to a table drops all of its GSI entries,
+// since a write may move an item out of an index partition without us knowing
+// where it used to be.
+
+func gsiLayer(table, index string) string {
+	return tableHashKey(table, nil, index)
+}
+
+func gsiItemKey(table string, item map[string]*dynamodb.AttributeValue, gsiSchema, tableSchema []*dynamodb.KeySchemaElement) string {
+	var key strings.Builder
+	writeItemKey(&key, table, item, gsiSchema)
+	key.WriteByte('@')
+	writeItemKey(&key, table, item, tableSchema)
+	return key.String()
+}
+
+func (c *Cache) isGSI(ctx aws.Context, table, index string, opts ...request.Option) bool {
+	desc, err := c.desc(ctx, table, opts...)
+	if err != nil {
+		return false
+	}
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		if *gsi.IndexName == index {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheGSIItems stores the items of a GSI query result in the GSI item cache.
+func (c *Cache) cacheGSIItems(ctx aws.Context, input *dynamodb.QueryInput, gsiSchema []*dynamodb.KeySchemaElement, out *dynamodb.QueryOutput, opts ...request.Option) {
+	if c.gsiItems == nil || input.IndexName == nil || len(out.Items) == 0 {
+		return
+	}
+	// items must have everything the index projects, not a subset of it
+	if input.ProjectionExpression != nil || len(input.AttributesToGet) > 0 {
+		return
+	}
+	switch aws.StringValue(input.Select) {
+	case "", dynamodb.SelectAllAttributes, dynamodb.SelectAllProjectedAttributes:
+	default:
+		return
+	}
+	table, index := *input.TableName, *input.IndexName
+	if !c.isGSI(ctx, table, index, opts...) {
+		return
+	}
+	tableSchema, err := c.schemaOf(ctx, table, opts...)
+	if err != nil {
+		return
+	}
+	layer := gsiLayer(table, index)
+	for _, item := range out.Items {
+		key := gsiItemKey(table, item, gsiSchema, tableSchema)
+		item, ok := c.transform(table, item)
+		if !ok {
+			c.gsiItems.Delete(c.cacheKey(layer), c.cacheKey(key))
+			continue
+		}
+		c.log(LogEntry{Op: "Query", Table: table, Key: key, Msg: "caching gsi item", TTL: time.Duration(c.queryTTL.Load())})
+		c.gsiItems.Set(c.cacheKey(layer), c.cacheKey(key), item, time.Duration(c.queryTTL.Load()))
+		c.sizes.gsiItems.add(key, item)
+	}
+}
+
+// IndexItem returns the item with the given key that an earlier query of the global secondary
+// index cached, see WithGSIItemCache. key must hold the index's key attributes as well as the table's,
+// since index keys aren't unique. The item only has the attributes projected into the index.
+// It reports false if the item isn't cached, and never reads it from DynamoDB.
+func (c *Cache) IndexItem(ctx aws.Context, table, index string, key map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, bool) {
+	if c.gsiItems == nil || !c.Enabled() || !c.isAllowed(table) || !c.isGSI(ctx, table, index) {
+		return nil, false
+	}
+	gsiSchema, err := c.schemaOfIndex(ctx, table, index)
+	if err != nil {
+		return nil, false
+	}
+	tableSchema, err := c.schemaOf(ctx, table)
+	if err != nil {
+		return nil, false
+	}
+	ik := gsiItemKey(table, key, gsiSchema, tableSchema)
+	item, ok := c.getGSIItem(table, index, ik)
+	if !c.lookup(ctx, ok, LogEntry{Op: "IndexItem", Table: table, Key: ik, Args: []interface{}{index}}) {
+		return nil, false
+	}
+	return item, true
+}
+
+func (c *Cache) getGSIItem(table, index, key string) (map[string]*dynamodb.AttributeValue, bool) {
+	item := c.gsiItems.Get(c.cacheKey(gsiLayer(table, index)), c.cacheKey(key))
+	if item == nil || item.Expired() {
+		return nil, false
+	}
+	return item.Value().(map[string]*dynamodb.AttributeValue), true
+}
+
+func (c *Cache) invalidateGSIItems(table string, gsis []*dynamodb.GlobalSecondaryIndexDescription) {
+	if c.gsiItems == nil {
+		return
+	}
+	for _, gsi := range gsis {
+		if !c.cachesIndex(table, *gsi.IndexName) {
+			continue
+		}
+		c.gsiItems.DeleteAll(c.cacheKey(gsiLayer(table, *gsi.IndexName)))
+	}
+}
@@ -0,0 +1,86 @@
+package localcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestIndexItem(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithGSIItemCache())
+	f.put("T", item("pk", "a", "sk", "1", "g", "x", "v", "old"))
+
+	want := item("pk", "a", "sk", "1", "g", "x")
+	if _, ok := c.IndexItem(ctx, "T", "gsi", want); ok {
+		t.Fatal("item cached before querying")
+	}
+	if _, err := c.QueryWithContext(ctx, indexQuery("gsi", "x")); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.IndexItem(ctx, "T", "gsi", want)
+	if !ok {
+		t.Fatal("item not cached by query")
+	}
+	if aws.StringValue(got["v"].S) != "old" {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := c.IndexItem(ctx, "T", "keys", want); ok {
+		t.Error("item cached for an index that wasn't queried")
+	}
+	if out, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")}); err != nil || f.count("GetItem") != 1 {
+		t.Errorf("GetItem served from the GSI item cache: %v %v", out, err)
+	}
+
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "1", "g", "x", "v", "new")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.IndexItem(ctx, "T", "gsi", want); ok {
+		t.Error("item still cached after write")
+	}
+}
+
+// TestQueryDoesntCacheItems queries a KEYS_ONLY index, whose partial items must never
+// be served to GetItem.
+func TestQueryDoesntCacheItems(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithGSIItemCache())
+	f.put("T", item("pk", "a", "sk", "1", "g", "x", "v", "1"))
+	for _, index := range []string{"keys", "gsi"} {
+		out, err := c.QueryWithContext(ctx, indexQuery(index, "x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Items) != 1 {
+			t.Fatalf("queried %d items from %s", len(out.Items), index)
+		}
+	}
+	if n := c.items.ItemCount(); n != 0 {
+		t.Errorf("queries cached %d items", n)
+	}
+	if got := getItem(t, c, key("a", "1")); aws.StringValue(got["v"].S) != "1" {
+		t.Errorf("got partial item %v", got)
+	}
+}
+
+// TestConsistentIndexQuery checks that strongly consistent index queries,
+// which DynamoDB rejects, are passed through rather than cached.
+func TestConsistentIndexQuery(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	input := indexQuery("gsi", "x")
+	input.ConsistentRead = aws.Bool(true)
+	for i := 0; i < 2; i++ {
+		if _, err := c.QueryWithContext(ctx, input); err == nil {
+			t.Fatal("consistent index query succeeded")
+		}
+	}
+	if got := f.count("Query"); got != 2 {
+		t.Errorf("Query called %d times, want 2", got)
+	}
+	if got := c.Stats().MissCount; got != 0 {
+		t.Errorf("counted %d misses", got)
+	}
+}
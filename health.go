@@ -0,0 +1,79 @@
+package localcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// maxErrorTables bounds how many tables we remember errors for.
+const maxErrorTables = 1024
+
+type tableError struct {
+	err error
+	at  time.Time
+}
+
+type errorLog struct {
+	mu   sync.Mutex
+	errs map[string]tableError
+}
+
+// LastError returns the most recent error from DynamoDB observed for the given table
+// (such as a throttle or a failed DescribeTable), and when it happened.
+// It returns a nil error if none has been seen.
+func (c *Cache) LastError(table string) (error, time.Time) {
+	c.errlog.mu.Lock()
+	defer c.errlog.mu.Unlock()
+	te := c.errlog.errs[table]
+	return te.err, te.at
+}
+
+func (c *Cache) recordError(table string, err error) {
+	c.errlog.mu.Lock()
+	defer c.errlog.mu.Unlock()
+	if c.errlog.errs == nil {
+		c.errlog.errs = make(map[string]tableError)
+	}
+	if _, ok := c.errlog.errs[table]; !ok && len(c.errlog.errs) >= maxErrorTables {
+		// forget the stalest one to make room
+		var oldest string
+		var oldestAt time.Time
+		for t, te := range c.errlog.errs {
+			if oldest == "" || te.at.Before(oldestAt) {
+				oldest, oldestAt = t, te.at
+			}
+		}
+		delete(c.errlog.errs, oldest)
+	}
+	c.errlog.errs[table] = tableError{err: err, at: time.Now()}
+}
+
+func transactTables(input *dynamodb.TransactWriteItemsInput) []string {
+	seen := make(map[string]struct{})
+	var tables []string
+	add := func(table *string) {
+		if table == nil {
+			return
+		}
+		if _, ok := seen[*table]; ok {
+			return
+		}
+		seen[*table] = struct{}{}
+		tables = append(tables, *table)
+	}
+	for _, item := range input.TransactItems {
+		switch {
+		case item.Put != nil:
+			add(item.Put.TableName)
+		case item.Delete != nil:
+			add(item.Delete.TableName)
+		case item.Update != nil:
+			add(item.Update.TableName)
+		case item.ConditionCheck != nil:
+			add(item.ConditionCheck.TableName)
+		}
+	}
+	return tables
+}
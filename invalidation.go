@@ -0,0 +1,204 @@
+package localcache
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// invalidation collects the cache entries made stale by a set of written items,
+// so that writes touching the same table or partition (such as in a large
+// transaction) only drop each of them once.
+type invalidation struct {
+	cache      *Cache
+	ctx        aws.Context
+	opts       []request.Option
+	tables     map[string]*dynamodb.DescribeTableOutput
+	partitions map[string]struct{}
+	// scan layers to drop, see scanLayer
+	layers map[string]struct{}
+	// keys of the items, by item key, for the invalidation publisher (if any)
+	keys map[string]publishedKey
+}
+
+func (c *Cache) newInvalidation(ctx aws.Context, opts ...request.Option) *invalidation {
+	inv := &invalidation{
+		cache:      c,
+		ctx:        ctx,
+		opts:       opts,
+		tables:     make(map[string]*dynamodb.DescribeTableOutput),
+		partitions: make(map[string]struct{}),
+		layers:     make(map[string]struct{}),
+	}
+	if c.publisher != nil {
+		inv.keys = make(map[string]publishedKey)
+	}
+	return inv
+}
+
+// add marks item's table scans and the query partitions it belongs to as stale.
+func (inv *invalidation) add(table string, item map[string]*dynamodb.AttributeValue) {
+	inv.layers[table] = struct{}{}
+	desc, seen := inv.tables[table]
+	if !seen {
+		var err error
+		desc, err = inv.cache.desc(inv.ctx, table, inv.opts...)
+		if err != nil {
+			// the write already went through, so there's nobody to return this to
+			inv.cache.handleError(fmt.Errorf("localcache: invalidate %s: %w", table, err))
+		}
+		inv.tables[table] = desc
+	}
+	if desc == nil {
+		return
+	}
+	if inv.keys != nil {
+		schema := desc.Table.KeySchema
+		inv.keys[itemKey(table, item, schema)] = publishedKey{table: table, key: keyOf(item, schema)}
+	}
+	inv.addPartition(table, "", desc.Table.KeySchema, item)
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		if inv.cache.cachesIndex(table, *gsi.IndexName) {
+			inv.addPartition(table, *gsi.IndexName, gsi.KeySchema, item)
+		}
+		inv.addIndexScans(table, *gsi.IndexName, gsi.KeySchema, item)
+	}
+	for _, lsi := range desc.Table.LocalSecondaryIndexes {
+		if inv.cache.cachesIndex(table, *lsi.IndexName) {
+			inv.addPartition(table, *lsi.IndexName, lsi.KeySchema, item)
+		}
+		inv.addIndexScans(table, *lsi.IndexName, lsi.KeySchema, item)
+	}
+}
+
+// addIndexScans marks the scans of an index as stale, if they're cached apart from
+// the table's (see WithIndexScopedScanCache) and item is in the index.
+// Items without all of the index's key attributes aren't.
+func (inv *invalidation) addIndexScans(table, index string, schema []*dynamodb.KeySchemaElement, item map[string]*dynamodb.AttributeValue) {
+	if !inv.cache.indexScopedScans {
+		return
+	}
+	for _, elem := range schema {
+		if _, ok := item[*elem.AttributeName]; !ok {
+			return
+		}
+	}
+	inv.layers[tableHashKey(table, nil, index)] = struct{}{}
+}
+
+// addPartition marks the table or index partition that item belongs to as stale.
+// Items without the index's hash key aren't in the index, so there's nothing to drop for them.
+func (inv *invalidation) addPartition(table, index string, schema []*dynamodb.KeySchemaElement, item map[string]*dynamodb.AttributeValue) {
+	var hk *dynamodb.AttributeValue
+	if rangeKey(schema) != "" {
+		var ok bool
+		if hk, ok = item[hashKey(schema)]; !ok {
+			return
+		}
+	}
+	inv.partitions[inv.cache.queryPartition(table, index, schema, hk)] = struct{}{}
+}
+
+// queryPartition is the package-level queryPartition, qualified by the table's epoch.
+func (c *Cache) queryPartition(table, index string, schema []*dynamodb.KeySchemaElement, hk *dynamodb.AttributeValue) string {
+	partition := queryPartition(table, index, schema, hk)
+	if epoch := c.epoch(table); epoch > 0 {
+		partition += "~" + strconv.FormatUint(epoch, 10)
+	}
+	return partition
+}
+
+func (c *Cache) epoch(table string) uint64 {
+	if v, ok := c.epochs.Load(table); ok {
+		return v.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// invalidateTable drops every cached query and scan of table, for when a write's effect
+// on them can't be narrowed down. The query cache can't enumerate a table's partitions,
+// so instead every partition is moved to a new epoch, and the old ones left to expire.
+func (c *Cache) invalidateTable(ctx aws.Context, table string, opts ...request.Option) {
+	v, _ := c.epochs.LoadOrStore(table, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+	c.log(LogEntry{Table: table, Msg: "invalidate table"})
+
+	c.dropScans(table)
+	desc, err := c.desc(ctx, table, opts...)
+	if err != nil {
+		c.handleError(fmt.Errorf("localcache: invalidate %s: %w", table, err))
+		return
+	}
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		c.dropScans(tableHashKey(table, nil, *gsi.IndexName))
+	}
+	for _, lsi := range desc.Table.LocalSecondaryIndexes {
+		c.dropScans(tableHashKey(table, nil, *lsi.IndexName))
+	}
+	c.invalidateGSIItems(table, desc.Table.GlobalSecondaryIndexes)
+}
+
+func (inv *invalidation) run() {
+	for layer := range inv.layers {
+		inv.cache.dropScans(layer)
+	}
+	for table, desc := range inv.tables {
+		if desc != nil {
+			inv.cache.invalidateGSIItems(table, desc.Table.GlobalSecondaryIndexes)
+		}
+	}
+	for key := range inv.partitions {
+		inv.cache.log(LogEntry{Key: key, Msg: "invalidate"})
+		inv.cache.deleteQueries(key)
+	}
+	for _, pk := range inv.keys {
+		inv.cache.publish(pk.table, pk.key)
+	}
+}
+
+var attrName = regexp.MustCompile(`[:#]?[A-Za-z_][A-Za-z0-9_]*`)
+
+// updatesIndexKey reports whether an update might change any of the table's index key attributes,
+// moving the item out of (or between) index partitions. That isn't visible from the
+// updated item alone, so the old item needs to be known to invalidate its partitions.
+// It errs on the side of yes: every name in the update expression counts, keywords included.
+func updatesIndexKey(desc *dynamodb.DescribeTableOutput, input *dynamodb.UpdateItemInput) bool {
+	touched := make(map[string]struct{})
+	for name := range input.AttributeUpdates {
+		touched[name] = struct{}{}
+	}
+	for _, tok := range attrName.FindAllString(aws.StringValue(input.UpdateExpression), -1) {
+		switch tok[0] {
+		case ':':
+			continue
+		case '#':
+			name, ok := input.ExpressionAttributeNames[tok]
+			if !ok || name == nil {
+				continue
+			}
+			tok = *name
+		}
+		touched[tok] = struct{}{}
+	}
+
+	var schemas [][]*dynamodb.KeySchemaElement
+	for _, gsi := range desc.Table.GlobalSecondaryIndexes {
+		schemas = append(schemas, gsi.KeySchema)
+	}
+	for _, lsi := range desc.Table.LocalSecondaryIndexes {
+		schemas = append(schemas, lsi.KeySchema)
+	}
+	for _, schema := range schemas {
+		for _, elem := range schema {
+			if _, ok := touched[aws.StringValue(elem.AttributeName)]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,461 @@
+package localcache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// BenchmarkTransactWriteItems25 writes 25 items to the same few partitions per transaction,
+// which invalidation should only drop once each.
+func BenchmarkTransactWriteItems25(b *testing.B) {
+	ctx := context.Background()
+	c, _ := newTestCache(b)
+	input := &dynamodb.TransactWriteItemsInput{}
+	for i := 0; i < 25; i++ {
+		n := strconv.Itoa(i)
+		input.TransactItems = append(input.TransactItems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String("T"),
+				Item:      item("pk", strconv.Itoa(i%5), "sk", n, "g", strconv.Itoa(i%3)),
+			},
+		})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.TransactWriteItemsWithContext(ctx, input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func tableQuery(pk string) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		TableName:              aws.String("T"),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {S: aws.String(pk)},
+		},
+	}
+}
+
+// TestDeleteNothing deletes an item DynamoDB returns no attributes for,
+// which leaves no telling which of the table's partitions it was in.
+func TestDeleteNothing(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	queries := []*dynamodb.QueryInput{tableQuery("a"), tableQuery("b"), indexQuery("gsi", "x")}
+	for _, q := range queries {
+		if _, err := c.QueryWithContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out, err := c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("T"), Key: key("a", "1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Attributes) != 0 {
+		t.Fatalf("deleted %v", out.Attributes)
+	}
+	for _, q := range queries {
+		if _, err := c.QueryWithContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.count("Query"); got != 6 {
+		t.Errorf("queried DynamoDB %d times, want 6: every query of the table should be dropped", got)
+	}
+}
+
+// TestBatchPutPrefetch moves items from one GSI partition to another in a single batch.
+func TestBatchPutPrefetch(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithBatchPutPrefetch())
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+	f.put("T", item("pk", "b", "sk", "1", "g", "x"))
+	query := func(g string) []map[string]*dynamodb.AttributeValue {
+		t.Helper()
+		out, err := c.QueryWithContext(ctx, indexQuery("gsi", g))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.Items
+	}
+	if got := len(query("x")); got != 2 {
+		t.Fatalf("got %d items in x", got)
+	}
+	if got := len(query("y")); got != 0 {
+		t.Fatalf("got %d items in y", got)
+	}
+
+	_, err := c.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{
+			"T": {
+				{PutRequest: &dynamodb.PutRequest{Item: item("pk", "a", "sk", "1", "g", "y")}},
+				{PutRequest: &dynamodb.PutRequest{Item: item("pk", "b", "sk", "1", "g", "y")}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(query("x")); got != 0 {
+		t.Errorf("got %d items still in x", got)
+	}
+	if got := len(query("y")); got != 2 {
+		t.Errorf("got %d items in y, want 2", got)
+	}
+}
+
+func TestTransactConditionCheck(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1", "v", "checked"))
+	getItem(t, c, key("a", "1"))
+	before, _ := c.ItemTTL("T", key("a", "1"))
+
+	_, err := c.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{ConditionCheck: &dynamodb.ConditionCheck{
+				TableName:           aws.String("T"),
+				Key:                 key("a", "1"),
+				ConditionExpression: aws.String("attribute_exists(pk)"),
+			}},
+			{Put: &dynamodb.Put{TableName: aws.String("T"), Item: item("pk", "a", "sk", "2", "v", "put")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, ok := c.ItemTTL("T", key("a", "1")); !ok || after > before {
+		t.Errorf("checked item's cache entry was replaced or dropped: TTL %v, then %v, %v", before, after, ok)
+	}
+	if got := aws.StringValue(getItem(t, c, key("a", "1"))["v"].S); got != "checked" {
+		t.Errorf("checked item is %q", got)
+	}
+	if got := aws.StringValue(getItem(t, c, key("a", "2"))["v"].S); got != "put" {
+		t.Errorf("put item is %q", got)
+	}
+	if got := f.count("GetItem"); got != 1 {
+		t.Errorf("GetItem called %d times, want 1", got)
+	}
+}
+
+func TestNoInputMutation(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithNoInputMutation())
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+	queries := []*dynamodb.QueryInput{indexQuery("gsi", "x"), tableQuery("b")}
+	for _, q := range queries {
+		if _, err := c.QueryWithContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	del := &dynamodb.DeleteItemInput{TableName: aws.String("T"), Key: key("a", "1")}
+	if _, err := c.DeleteItemWithContext(ctx, del); err != nil {
+		t.Fatal(err)
+	}
+	if del.ReturnValues != nil {
+		t.Errorf("DeleteItem set ReturnValues to %s", *del.ReturnValues)
+	}
+	update := &dynamodb.UpdateItemInput{
+		TableName:                 aws.String("T"),
+		Key:                       key("c", "1"),
+		UpdateExpression:          aws.String("SET v = :v"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("1")}},
+	}
+	if _, err := c.UpdateItemWithContext(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if update.ReturnValues != nil {
+		t.Errorf("UpdateItem set ReturnValues to %s", *update.ReturnValues)
+	}
+
+	for _, q := range queries {
+		if _, err := c.QueryWithContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the deleted item's index partition, but not the whole table
+	if got := f.count("Query"); got != 3 {
+		t.Errorf("queried DynamoDB %d times, want 3", got)
+	}
+}
+
+// TestUpdateReturnValues moves an item from one GSI partition to another with each ReturnValues mode.
+func TestUpdateReturnValues(t *testing.T) {
+	modes := []string{
+		dynamodb.ReturnValueAllNew,
+		dynamodb.ReturnValueAllOld,
+		dynamodb.ReturnValueUpdatedNew,
+		dynamodb.ReturnValueUpdatedOld,
+		dynamodb.ReturnValueNone,
+	}
+	for _, mode := range modes {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			c, f := newTestCache(t, WithNoInputMutation())
+			f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+			query := func(g string) int {
+				t.Helper()
+				out, err := c.QueryWithContext(ctx, indexQuery("gsi", g))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return len(out.Items)
+			}
+			query("x")
+			query("y")
+			getItem(t, c, key("a", "1"))
+
+			input := &dynamodb.UpdateItemInput{
+				TableName:                 aws.String("T"),
+				Key:                       key("a", "1"),
+				UpdateExpression:          aws.String("SET g = :g"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":g": {S: aws.String("y")}},
+				ReturnValues:              aws.String(mode),
+			}
+			if _, err := c.UpdateItemWithContext(ctx, input); err != nil {
+				t.Fatal(err)
+			}
+			if got := aws.StringValue(input.ReturnValues); got != mode {
+				t.Errorf("ReturnValues changed to %s", got)
+			}
+			if n := query("x"); n != 0 {
+				t.Errorf("%d items still in x", n)
+			}
+			if n := query("y"); n != 1 {
+				t.Errorf("%d items in y, want 1", n)
+			}
+			if got := aws.StringValue(getItem(t, c, key("a", "1"))["g"].S); got != "y" {
+				t.Errorf("cached item has g = %q", got)
+			}
+		})
+	}
+}
+
+// TestCompositeIndexKeyChange writes an item so that its hash and range keys change
+// in an index with a range key of its own. Queries of the old index partition must be dropped,
+// and of the new one too if the item joined it.
+func TestCompositeIndexKeyChange(t *testing.T) {
+	ctx := context.Background()
+	writes := map[string]func(c *Cache) error{
+		"PutItem": func(c *Cache) error {
+			_, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("G"), Item: item("pk", "a", "sk", "1", "g", "y", "r", "2")})
+			return err
+		},
+		"UpdateItem": func(c *Cache) error {
+			_, err := c.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+				TableName:        aws.String("G"),
+				Key:              key("a", "1"),
+				UpdateExpression: aws.String("SET g = :g, r = :r"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":g": {S: aws.String("y")},
+					":r": {S: aws.String("2")},
+				},
+			})
+			return err
+		},
+		"DeleteItem": func(c *Cache) error {
+			_, err := c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("G"), Key: key("a", "1")})
+			return err
+		},
+	}
+	for _, tc := range []struct {
+		op         string
+		noMutation bool
+	}{
+		{"PutItem", false},
+		{"UpdateItem", false},
+		{"DeleteItem", false},
+		{"PutItem", true},
+		{"DeleteItem", true},
+	} {
+		op, write := tc.op, writes[tc.op]
+		var opts []Option
+		if tc.noMutation {
+			opts = append(opts, WithNoInputMutation())
+			op += " without input mutation"
+		}
+		c, f := newTestCache(t, opts...)
+		desc := testDesc("G")
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:  aws.String("g-r"),
+			KeySchema:  keySchema("g", "r"),
+			Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+		})
+		f.addTable(desc)
+		f.put("G", item("pk", "a", "sk", "1", "g", "x", "r", "1"))
+		query := func(g string) int {
+			t.Helper()
+			input := indexQuery("g-r", g)
+			input.TableName = aws.String("G")
+			out, err := c.QueryWithContext(ctx, input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return len(out.Items)
+		}
+		query("x")
+		query("y")
+
+		if err := write(c); err != nil {
+			t.Fatal(err)
+		}
+		before := f.count("Query")
+		if n := query("x"); n != 0 {
+			t.Errorf("%s: old index partition has %d items, want 0", op, n)
+		}
+		// deleted items don't join a new partition, so its query stays cached
+		want, queries := 1, 2
+		if tc.op == "DeleteItem" {
+			want, queries = 0, 1
+		}
+		if n := query("y"); n != want {
+			t.Errorf("%s: new index partition has %d items, want %d", op, n, want)
+		}
+		if got := f.count("Query") - before; got != queries {
+			t.Errorf("%s: queried DynamoDB %d times, want %d", op, got, queries)
+		}
+	}
+}
+
+// TestConditionalUpdate checks that an update whose condition fails leaves the cache alone,
+// while one that succeeds drops the item and the query partitions it was in.
+func TestConditionalUpdate(t *testing.T) {
+	ctx := context.Background()
+	for _, opts := range [][]Option{nil, {WithNoInputMutation()}} {
+		c, f := newTestCache(t, opts...)
+		f.put("T", item("pk", "a", "sk", "1", "g", "x", "v", "old"))
+		getItem(t, c, key("a", "1"))
+		if _, err := c.QueryWithContext(ctx, indexQuery("gsi", "x")); err != nil {
+			t.Fatal(err)
+		}
+		update := func() error {
+			_, err := c.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+				TableName:           aws.String("T"),
+				Key:                 key("a", "1"),
+				UpdateExpression:    aws.String("SET g = :g, v = :v"),
+				ConditionExpression: aws.String("v = :old"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":g":   {S: aws.String("y")},
+					":v":   {S: aws.String("new")},
+					":old": {S: aws.String("old")},
+				},
+			})
+			return err
+		}
+
+		f.on("UpdateItem", func([]byte) (interface{}, error) { return nil, errCondition })
+		if err := update(); err == nil {
+			t.Fatal("failed condition didn't return an error")
+		}
+		f.on("UpdateItem", nil)
+		gets := f.count("GetItem")
+		if v := aws.StringValue(getItem(t, c, key("a", "1"))["v"].S); v != "old" || f.count("GetItem") != gets {
+			t.Errorf("%d options: after a failed condition, got %q from %d reads, want the cached old item", len(opts), v, f.count("GetItem")-gets)
+		}
+
+		// the old item's partitions are invalidated before writing, failed or not, so cache it again
+		if _, err := c.QueryWithContext(ctx, indexQuery("gsi", "x")); err != nil {
+			t.Fatal(err)
+		}
+		queries := f.count("Query")
+		if err := update(); err != nil {
+			t.Fatal(err)
+		}
+		if v := aws.StringValue(getItem(t, c, key("a", "1"))["v"].S); v != "new" {
+			t.Errorf("%d options: got %q after a successful update, want new", len(opts), v)
+		}
+		out, err := c.QueryWithContext(ctx, indexQuery("gsi", "x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out.Items) != 0 || f.count("Query") != queries+1 {
+			t.Errorf("%d options: old index partition has %d items from %d queries after a successful update, want 0 from 1", len(opts), len(out.Items), f.count("Query")-queries)
+		}
+	}
+}
+
+func TestIndexScopedScans(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t, WithIndexScopedScanCache())
+	desc := testDesc("S")
+	desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+		IndexName:  aws.String("sparse"),
+		KeySchema:  keySchema("h", ""),
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+	})
+	f.addTable(desc)
+	f.put("S", item("pk", "a", "sk", "1", "g", "x"))
+	scans := []*dynamodb.ScanInput{
+		{TableName: aws.String("S")},
+		{TableName: aws.String("S"), IndexName: aws.String("gsi")},
+		{TableName: aws.String("S"), IndexName: aws.String("keys")},
+		{TableName: aws.String("S"), IndexName: aws.String("sparse")},
+		{TableName: aws.String("T")},
+		{TableName: aws.String("T"), IndexName: aws.String("gsi")},
+	}
+	// whether each scan is refreshed after the write
+	want := []bool{true, true, true, false, false, false}
+	for _, scan := range scans {
+		if _, err := c.ScanWithContext(ctx, scan); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("S"), Item: item("pk", "b", "sk", "1", "g", "y")}); err != nil {
+		t.Fatal(err)
+	}
+	for i, scan := range scans {
+		before := f.count("Scan")
+		if _, err := c.ScanWithContext(ctx, scan); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.count("Scan") > before; got != want[i] {
+			t.Errorf("scan of %s index %q: refreshed %v, want %v", *scan.TableName, aws.StringValue(scan.IndexName), got, want[i])
+		}
+	}
+}
+
+func TestPrefetchConsistency(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		opts []Option
+		want bool
+	}{
+		{nil, true},
+		{[]Option{WithPrefetchConsistency(false)}, false},
+		{[]Option{WithPrefetchConsistency(false, "U")}, true},
+		{[]Option{WithPrefetchConsistency(false), WithPrefetchConsistency(true, "T")}, true},
+		{[]Option{WithPrefetchConsistency(true), WithPrefetchConsistency(false, "T")}, false},
+	} {
+		c, f := newTestCache(t, append(tc.opts, WithNoInputMutation())...)
+		var got []bool
+		f.on("BatchGetItem", func(body []byte) (interface{}, error) {
+			var in dynamodb.BatchGetItemInput
+			if err := decode(body, &in); err != nil {
+				return nil, err
+			}
+			got = append(got, aws.BoolValue(in.RequestItems["T"].ConsistentRead))
+			return &dynamodb.BatchGetItemOutput{}, nil
+		})
+		_, err := c.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:                 aws.String("T"),
+			Key:                       key("a", "1"),
+			UpdateExpression:          aws.String("SET v = :v"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("x")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%d options: prefetched with ConsistentRead %v, want %v", len(tc.opts), got, tc.want)
+		}
+	}
+}
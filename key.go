@@ -2,13 +2,23 @@ package localcache
 
 import (
 	"bytes"
-	"fmt"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
 
+// KeyVersion identifies the format of cache keys, and prefixes every key the cache stores.
+// It is bumped whenever the way keys are built changes, so that entries written by older
+// versions of this package to a backend that outlives a deploy (see WithBackend) are never
+// read back with a different meaning: they're simply missed, and left to expire.
+const KeyVersion = "v1"
+
 func tableHashKey(table string, hk *dynamodb.AttributeValue, idx string) string {
 	var key strings.Builder
 	key.WriteString(table)
@@ -23,6 +33,32 @@ func tableHashKey(table string, hk *dynamodb.AttributeValue, idx string) string
 	return key.String()
 }
 
+// cacheKey returns key as stored in a backend, prefixed by KeyVersion: as-is if it fits
+// within the configured maximum key length, or its SHA-256 hash otherwise. Short keys stay
+// readable for debugging, while pathologically long ones don't bloat the cache.
+func (c *Cache) cacheKey(key string) string {
+	if c.maxKeyLen <= 0 || len(key) <= c.maxKeyLen {
+		return KeyVersion + ":" + key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return KeyVersion + ":sha256:" + hex.EncodeToString(sum[:])
+}
+
+// queryPartition returns the primary key that queries against the given table or index
+// are layered under in the query cache: the table, index, and hash key value.
+// Every variation of a query against a partition (range key conditions, filters,
+// pagination, and so on) is stored as a secondary key under it, so LayeredCache.DeleteAll
+// on the partition drops all of them at once. Both query caching and invalidation
+// must go through here so that they agree on the partition.
+//
+// For tables or indexes with only a hash key, queries are layered by the whole table or index.
+func queryPartition(table, index string, schema []*dynamodb.KeySchemaElement, hk *dynamodb.AttributeValue) string {
+	if rangeKey(schema) == "" {
+		return tableHashKey(table, nil, index)
+	}
+	return tableHashKey(table, hk, index)
+}
+
 func itemKey(table string, key map[string]*dynamodb.AttributeValue, schema []*dynamodb.KeySchemaElement) string {
 	var str strings.Builder
 	writeItemKey(&str, table, key, schema)
@@ -32,24 +68,47 @@ func itemKey(table string, key map[string]*dynamodb.AttributeValue, schema []*dy
 func writeItemKey(str *strings.Builder, table string, key map[string]*dynamodb.AttributeValue, schema []*dynamodb.KeySchemaElement) {
 	str.WriteString(table)
 	str.WriteByte('$')
-	str.WriteString(*schema[0].AttributeName)
+	hk := hashKey(schema)
+	str.WriteString(hk)
 	str.WriteByte(':')
-	writeAV(str, key[*schema[0].AttributeName])
-	if len(schema) > 1 {
+	writeAV(str, key[hk])
+	if rk := rangeKey(schema); rk != "" {
 		str.WriteByte('/')
-		str.WriteString(*schema[1].AttributeName)
+		str.WriteString(rk)
 		str.WriteByte(':')
-		writeAV(str, key[*schema[1].AttributeName])
+		writeAV(str, key[rk])
+	}
+}
+
+// hashKey returns the name of schema's hash key attribute.
+// Key schemas aren't necessarily listed hash key first, so it goes by KeyType.
+func hashKey(schema []*dynamodb.KeySchemaElement) string {
+	return keyOfType(schema, dynamodb.KeyTypeHash)
+}
+
+// rangeKey returns the name of schema's range key attribute, or "" if it doesn't have one.
+func rangeKey(schema []*dynamodb.KeySchemaElement) string {
+	return keyOfType(schema, dynamodb.KeyTypeRange)
+}
+
+func keyOfType(schema []*dynamodb.KeySchemaElement, keyType string) string {
+	for _, elem := range schema {
+		if aws.StringValue(elem.KeyType) == keyType {
+			return aws.StringValue(elem.AttributeName)
+		}
 	}
+	return ""
 }
 
-func queryKey(input *dynamodb.QueryInput, schema []*dynamodb.KeySchemaElement) string {
+// queryKey identifies a query within its partition. conds are its key conditions, see keyConditions.
+func queryKey(input *dynamodb.QueryInput, schema []*dynamodb.KeySchemaElement, conds map[string]*dynamodb.Condition) string {
 	var key strings.Builder
 	if input.Select != nil {
 		key.WriteString(*input.Select)
 	} else {
 		key.WriteByte('*')
 	}
+	writeProjection(&key, input.ProjectionExpression, input.AttributesToGet, input.ExpressionAttributeNames)
 	if input.ScanIndexForward == nil || (input.ScanIndexForward != nil && *input.ScanIndexForward == true) {
 		key.WriteString(".f ")
 	} else {
@@ -59,15 +118,15 @@ func queryKey(input *dynamodb.QueryInput, schema []*dynamodb.KeySchemaElement) s
 		key.WriteString(*input.IndexName)
 		key.WriteByte('#')
 	}
-	// TODO: KeyConditionExpression
-	key.WriteString(*schema[0].AttributeName)
+	hk := hashKey(schema)
+	key.WriteString(hk)
 	key.WriteByte('`')
-	writeCond(&key, input.KeyConditions[*schema[0].AttributeName])
-	if len(input.KeyConditions) > 1 {
+	writeCond(&key, conds[hk])
+	if rk := rangeKey(schema); rk != "" && conds[rk] != nil {
 		key.WriteByte('&')
-		key.WriteString(*schema[1].AttributeName)
+		key.WriteString(rk)
 		key.WriteByte('`')
-		writeCond(&key, input.KeyConditions[*schema[1].AttributeName])
+		writeCond(&key, conds[rk])
 	}
 	if len(input.ExclusiveStartKey) > 0 {
 		key.WriteByte('@')
@@ -91,6 +150,7 @@ func scanKey(input *dynamodb.ScanInput, schema []*dynamodb.KeySchemaElement) str
 	} else {
 		key.WriteByte('*')
 	}
+	writeProjection(&key, input.ProjectionExpression, input.AttributesToGet, input.ExpressionAttributeNames)
 	if input.IndexName != nil {
 		key.WriteString(*input.IndexName + "#")
 	}
@@ -109,6 +169,18 @@ func scanKey(input *dynamodb.ScanInput, schema []*dynamodb.KeySchemaElement) str
 	return key.String()
 }
 
+// writeProjection writes the normalized projection, if any.
+// Select=SPECIFIC_ATTRIBUTES alone doesn't tell queries apart, so it's needed to keep
+// queries with different projections from sharing a key.
+func writeProjection(w *strings.Builder, expr *string, attrs []*string, names map[string]*string) {
+	if !isProjected(expr, attrs) {
+		return
+	}
+	w.WriteByte('{')
+	w.WriteString(projectionKey(expr, attrs, names))
+	w.WriteByte('}')
+}
+
 func writeCond(str *strings.Builder, cond *dynamodb.Condition) {
 	str.WriteString(*cond.ComparisonOperator)
 	str.WriteByte(' ')
@@ -126,65 +198,155 @@ func av2str(av *dynamodb.AttributeValue) string {
 	return str.String()
 }
 
+// writeAV writes a canonical encoding of av. Values of different types never
+// encode the same: strings are quoted, binary is base64 with a b prefix,
+// and sets and maps are sorted, so equal values always encode the same
+// no matter how they were built.
 func writeAV(w *strings.Builder, av *dynamodb.AttributeValue) {
 	if av == nil {
 		w.WriteString("<nil>")
+		return
 	}
 	switch {
 	case av.B != nil:
-		w.Write(av.B)
+		w.WriteByte('b')
+		w.WriteString(base64.StdEncoding.EncodeToString(av.B))
 	case av.BS != nil:
-		w.WriteString(fmt.Sprint(av.BS))
-	case av.BOOL != nil:
-		if *av.BOOL {
-			w.WriteString("true")
-		} else {
-			w.WriteString("false")
+		bs := make([]string, 0, len(av.BS))
+		for _, b := range av.BS {
+			bs = append(bs, "b"+base64.StdEncoding.EncodeToString(b))
 		}
+		writeSet(w, "BS", bs)
+	case av.BOOL != nil:
+		w.WriteString(strconv.FormatBool(*av.BOOL))
 	case av.N != nil:
-		w.WriteString(*av.N)
+		w.WriteString(canonicalNumber(*av.N))
 	case av.S != nil:
-		w.WriteString(*av.S)
+		w.WriteString(strconv.Quote(*av.S))
 	case av.L != nil:
-		w.WriteString("L:")
-		for _, item := range av.L {
+		w.WriteByte('[')
+		for i, item := range av.L {
+			if i > 0 {
+				w.WriteByte(',')
+			}
 			writeAV(w, item)
-			w.WriteByte(',')
 		}
+		w.WriteByte(']')
 	case av.NS != nil:
-		w.WriteString("NS:")
+		ns := make([]string, 0, len(av.NS))
 		for _, n := range av.NS {
-			w.WriteString(*n)
-			w.WriteByte(',')
+			ns = append(ns, canonicalNumber(aws.StringValue(n)))
 		}
+		writeSet(w, "NS", ns)
 	case av.SS != nil:
-		w.WriteString("SS:")
+		ss := make([]string, 0, len(av.SS))
 		for _, s := range av.SS {
-			w.WriteString(*s)
-			w.WriteByte(',')
+			ss = append(ss, strconv.Quote(aws.StringValue(s)))
 		}
+		writeSet(w, "SS", ss)
 	case av.M != nil:
-		w.WriteString("M:")
-		for k, v := range av.M {
-			w.WriteString(k)
-			w.WriteByte('=')
-			writeAV(w, v)
-			w.WriteByte(',')
+		keys := make([]string, 0, len(av.M))
+		for k := range av.M {
+			keys = append(keys, k)
 		}
+		sort.Strings(keys)
+		w.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(strconv.Quote(k))
+			w.WriteByte(':')
+			writeAV(w, av.M[k])
+		}
+		w.WriteByte('}')
 	case av.NULL != nil:
-		w.WriteString("NULL")
+		w.WriteString("null")
 	default:
-		panic("unsupported av")
+		// DynamoDB would reject this, but it shouldn't take the process down with it
+		w.WriteString("<empty>")
+	}
+}
+
+// canonicalNumber formats the DynamoDB number n so that equal numbers format the same,
+// such as 1, 1.0, and 10e-1, as its significant digits and exponent.
+// Anything that doesn't parse as a number is returned as-is.
+func canonicalNumber(n string) string {
+	var sign string
+	switch {
+	case strings.HasPrefix(n, "-"):
+		sign = "-"
+		n = n[1:]
+	case strings.HasPrefix(n, "+"):
+		n = n[1:]
+	}
+	num, exp := n, 0
+	if i := strings.IndexAny(n, "eE"); i >= 0 {
+		var err error
+		if exp, err = strconv.Atoi(n[i+1:]); err != nil {
+			return sign + n
+		}
+		num = n[:i]
+	}
+	whole, frac, _ := strings.Cut(num, ".")
+	digits := whole + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return sign + n
+	}
+	exp -= len(frac)
+	digits = strings.TrimLeft(digits, "0")
+	if digits == "" {
+		return "0"
+	}
+	for strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+	if exp == 0 {
+		return sign + digits
 	}
+	return sign + digits + "e" + strconv.Itoa(exp)
 }
 
+// writeSet writes the already encoded members of a set, in sorted order.
+func writeSet(w *strings.Builder, typ string, members []string) {
+	sort.Strings(members)
+	w.WriteString(typ)
+	w.WriteByte('[')
+	for i, m := range members {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteString(m)
+	}
+	w.WriteByte(']')
+}
+
+// writeExpr writes exp with its placeholders substituted. Longer placeholders
+// are replaced first, so that :ab is never mistaken for :a followed by b
+// regardless of map order.
 func writeExpr(w *strings.Builder, exp string, names map[string]*string, vals map[string]*dynamodb.AttributeValue) {
-	pairs := make([]string, 0, len(names)*2+len(vals)*2)
-	for k, v := range names {
-		pairs = append(pairs, k, *v)
+	placeholders := make([]string, 0, len(names)+len(vals))
+	for k := range names {
+		placeholders = append(placeholders, k)
 	}
-	for k, v := range vals {
-		pairs = append(pairs, k, av2str(v))
+	for k := range vals {
+		placeholders = append(placeholders, k)
+	}
+	sort.Slice(placeholders, func(i, j int) bool {
+		a, b := placeholders[i], placeholders[j]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	pairs := make([]string, 0, len(placeholders)*2)
+	for _, k := range placeholders {
+		if name, ok := names[k]; ok {
+			pairs = append(pairs, k, aws.StringValue(name))
+			continue
+		}
+		pairs = append(pairs, k, av2str(vals[k]))
 	}
 	replacer := strings.NewReplacer(pairs...)
 	replacer.WriteString(w, exp)
@@ -197,34 +359,24 @@ func keyEq(a, b map[string]*dynamodb.AttributeValue) bool {
 	return keyEqLoose(a, b)
 }
 
+// keyEqLoose reports whether every attribute in a has an equal counterpart in b.
+// Values are compared by their key encoding (see writeAV), so two keys are equal
+// exactly when the cache keys built from them are.
 func keyEqLoose(a, b map[string]*dynamodb.AttributeValue) bool {
 	for k, v := range a {
 		other, ok := b[k]
 		if !ok {
 			return false
 		}
-		switch {
-		case v.S != nil:
-			if other.S == nil {
-				return false
-			}
-			if *v.S != *other.S {
-				return false
-			}
-		case v.B != nil:
-			if other.B == nil {
-				return false
-			}
+		if v != nil && other != nil && v.B != nil && other.B != nil {
+			// binary keys are common (hashed IDs), so skip encoding them
 			if !bytes.Equal(v.B, other.B) {
 				return false
 			}
-		case v.N != nil:
-			if other.N == nil {
-				return false
-			}
-			if *v.N != *other.N {
-				return false
-			}
+			continue
+		}
+		if av2str(v) != av2str(other) {
+			return false
 		}
 	}
 	return true
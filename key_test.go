@@ -0,0 +1,261 @@
+package localcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var selects = []string{
+	dynamodb.SelectAllAttributes,
+	dynamodb.SelectAllProjectedAttributes,
+	dynamodb.SelectSpecificAttributes,
+	dynamodb.SelectCount,
+}
+
+func TestSelectKeys(t *testing.T) {
+	schema := keySchema("pk", "sk")
+	conds := map[string]*dynamodb.Condition{
+		"pk": {ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq), AttributeValueList: []*dynamodb.AttributeValue{{S: aws.String("a")}}},
+	}
+	queries := make(map[string]string)
+	scans := make(map[string]string)
+	for _, sel := range append(selects, "") {
+		query := tableQuery("a")
+		scan := &dynamodb.ScanInput{TableName: aws.String("T")}
+		if sel != "" {
+			query.Select = aws.String(sel)
+			scan.Select = aws.String(sel)
+		}
+		if k := queryKey(query, schema, conds); queries[k] != "" {
+			t.Errorf("queries with Select %q and %q share key %q", sel, queries[k], k)
+		} else {
+			queries[k] = "(" + sel + ")"
+		}
+		if k := scanKey(scan, schema); scans[k] != "" {
+			t.Errorf("scans with Select %q and %q share key %q", sel, scans[k], k)
+		} else {
+			scans[k] = "(" + sel + ")"
+		}
+	}
+}
+
+// TestCountNotServedAsItems caches a COUNT query and scan, and checks they aren't
+// served to requests for items.
+func TestCountNotServedAsItems(t *testing.T) {
+	ctx := context.Background()
+	for _, sel := range []*string{nil, aws.String(dynamodb.SelectAllAttributes), aws.String(dynamodb.SelectAllProjectedAttributes)} {
+		c, f := newTestCache(t)
+		f.put("T", item("pk", "a", "sk", "1", "g", "a"))
+		count := tableQuery("a")
+		count.Select = aws.String(dynamodb.SelectCount)
+		if _, err := c.QueryWithContext(ctx, count); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T"), Select: count.Select}); err != nil {
+			t.Fatal(err)
+		}
+
+		query := tableQuery("a")
+		if aws.StringValue(sel) == dynamodb.SelectAllProjectedAttributes {
+			// only valid for indexes
+			query = indexQuery("gsi", "a")
+		}
+		query.Select = sel
+		qout, err := c.QueryWithContext(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sout, err := c.ScanWithContext(ctx, &dynamodb.ScanInput{TableName: aws.String("T"), IndexName: query.IndexName, Select: sel})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(qout.Items) != 1 || len(sout.Items) != 1 {
+			t.Errorf("Select %s after COUNT: got %d items from the query and %d from the scan, want 1 each", aws.StringValue(sel), len(qout.Items), len(sout.Items))
+		}
+	}
+}
+
+// TestKeyEq checks that keyEq agrees with the cache keys built from the same keys.
+func TestKeyEq(t *testing.T) {
+	values := []*dynamodb.AttributeValue{
+		{S: aws.String("1")},
+		{S: aws.String("01")},
+		{S: aws.String("")},
+		num(1),
+		{N: aws.String("1.0")},
+		{N: aws.String("1e0")},
+		{N: aws.String("10")},
+		{B: []byte("1")},
+		{B: []byte{1}},
+		{B: []byte{0xff, 0xfe}},
+		{B: []byte{}},
+	}
+	for _, schema := range [][]*dynamodb.KeySchemaElement{keySchema("pk", ""), keySchema("pk", "sk")} {
+		var keys []map[string]*dynamodb.AttributeValue
+		for _, hk := range values {
+			if len(schema) == 1 {
+				keys = append(keys, map[string]*dynamodb.AttributeValue{"pk": hk})
+				continue
+			}
+			for _, rk := range values {
+				keys = append(keys, map[string]*dynamodb.AttributeValue{"pk": hk, "sk": rk})
+			}
+		}
+		for _, a := range keys {
+			for _, b := range keys {
+				same := itemKey("T", a, schema) == itemKey("T", b, schema)
+				if eq := keyEq(a, b); eq != same {
+					t.Errorf("keyEq(%v, %v) = %v, but their cache keys are equal: %v", a, b, eq, same)
+				}
+			}
+		}
+	}
+}
+
+// TestFilterValueKeys checks that filters differing only in the types or contents
+// of their values get different keys.
+func TestFilterValueKeys(t *testing.T) {
+	schema := keySchema("pk", "sk")
+	values := []*dynamodb.AttributeValue{
+		{BOOL: aws.Bool(true)},
+		{BOOL: aws.Bool(false)},
+		{S: aws.String("true")},
+		{NULL: aws.Bool(true)},
+		{B: []byte{0}},
+		{B: []byte{0, 0}},
+		{B: []byte{0xff}},
+		{M: map[string]*dynamodb.AttributeValue{"a": {BOOL: aws.Bool(true)}}},
+		{M: map[string]*dynamodb.AttributeValue{"a": {BOOL: aws.Bool(false)}}},
+		{M: map[string]*dynamodb.AttributeValue{"a": {B: []byte{1}}}},
+		{M: map[string]*dynamodb.AttributeValue{"a": {M: map[string]*dynamodb.AttributeValue{"b": {S: aws.String("x")}}}}},
+		{M: map[string]*dynamodb.AttributeValue{"a": {M: map[string]*dynamodb.AttributeValue{"b": {S: aws.String("y")}}}}},
+		{M: map[string]*dynamodb.AttributeValue{"b": {M: map[string]*dynamodb.AttributeValue{"b": {S: aws.String("x")}}}}},
+		{M: map[string]*dynamodb.AttributeValue{}},
+	}
+	seen := make(map[string]*dynamodb.AttributeValue)
+	for _, v := range values {
+		input := &dynamodb.ScanInput{
+			TableName:                 aws.String("T"),
+			FilterExpression:          aws.String("v = :v"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": v},
+		}
+		k := scanKey(input, schema)
+		if other, ok := seen[k]; ok {
+			t.Errorf("filters on %v and %v share key %q", v, other, k)
+		}
+		seen[k] = v
+	}
+}
+
+func TestCanonicalNumber(t *testing.T) {
+	for n, want := range map[string]string{
+		"1":     "1",
+		"1.0":   "1",
+		"1e0":   "1",
+		"10e-1": "1",
+		"+1":    "1",
+		"-0":    "0",
+		"0":     "0",
+		"0.0":   "0",
+		"0.10":  "1e-1",
+		".1":    "1e-1",
+		"100":   "1e2",
+		"-1.50": "-15e-1",
+		"1E2":   "1e2",
+		"abc":   "abc",
+		"1e":    "1e",
+	} {
+		if got := canonicalNumber(n); got != want {
+			t.Errorf("canonicalNumber(%q) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+// TestNumberKeys reads the same items with differently spelled numeric keys,
+// which must hit the same cache entries.
+func TestNumberKeys(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.addTable(&dynamodb.TableDescription{TableName: aws.String("Num"), KeySchema: keySchema("pk", "sk")})
+	f.put("Num", map[string]*dynamodb.AttributeValue{"pk": num(1), "sk": {S: aws.String("1")}})
+	for _, n := range []string{"1", "1.0", "1e0", "10e-1"} {
+		k := map[string]*dynamodb.AttributeValue{"pk": {N: aws.String(n)}, "sk": {S: aws.String("1")}}
+		out, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("Num"), Key: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.Item == nil {
+			t.Errorf("GetItem with pk %s: not found", n)
+		}
+		_, err = c.QueryWithContext(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String("Num"),
+			KeyConditionExpression:    aws.String("pk = :pk"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": {N: aws.String(n)}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets, queries := f.count("GetItem"), f.count("Query"); gets != 1 || queries != 1 {
+		t.Errorf("got %d GetItems and %d Querys, want 1 each", gets, queries)
+	}
+}
+
+// TestReversedKeySchema checks that a table (and index) described with its range key first
+// gets the same item and query keys as one described with its hash key first.
+func TestReversedKeySchema(t *testing.T) {
+	ctx := context.Background()
+	normal, _ := newTestCache(t)
+	reversed, f := newTestCache(t)
+	f.addTable(reversedDesc("T"))
+
+	queries := []*dynamodb.QueryInput{tableQuery("a"), indexQuery("gsi", "x")}
+	rangeQuery := tableQuery("a")
+	rangeQuery.KeyConditionExpression = aws.String("sk = :sk AND pk = :pk")
+	rangeQuery.ExpressionAttributeValues[":sk"] = &dynamodb.AttributeValue{S: aws.String("1")}
+	indexRangeQuery := indexQuery("gsi", "x")
+	indexRangeQuery.KeyConditionExpression = aws.String("sk = :sk AND g = :g")
+	indexRangeQuery.ExpressionAttributeValues[":sk"] = &dynamodb.AttributeValue{S: aws.String("1")}
+	queries = append(queries, rangeQuery, indexRangeQuery)
+
+	type keys struct {
+		item, partition, query []string
+	}
+	var got [2]keys
+	for i, c := range []*Cache{normal, reversed} {
+		schema, err := c.schemaOf(ctx, "T")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[i].item = append(got[i].item, itemKey("T", key("a", "1"), schema))
+		for _, q := range queries {
+			_, partition, key, err := c.queryKeys(ctx, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[i].partition = append(got[i].partition, partition)
+			got[i].query = append(got[i].query, key)
+		}
+	}
+	if fmt.Sprint(got[0]) != fmt.Sprint(got[1]) {
+		t.Errorf("keys differ:\nhash first:  %v\nrange first: %v", got[0], got[1])
+	}
+
+	// and the cache works end to end
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+	for i := 0; i < 2; i++ {
+		if it := getItem(t, reversed, key("a", "1")); it == nil {
+			t.Fatal("item not found")
+		}
+		if _, err := reversed.QueryWithContext(ctx, rangeQuery); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gets, qs := f.count("GetItem"), f.count("Query"); gets != 1 || qs != 1 {
+		t.Errorf("got %d GetItems and %d Querys, want 1 each", gets, qs)
+	}
+}
@@ -0,0 +1,248 @@
+package localcache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// errUnsupportedKeyCondition is returned for queries whose key conditions can't be cached.
+// Such queries aren't a problem with the cache, so they're passed through to DynamoDB,
+// which may well reject them too.
+var errUnsupportedKeyCondition = errors.New("localcache: unsupported key condition")
+
+// keyConditions returns a query's key conditions by attribute name, parsing
+// KeyConditionExpression into the equivalent legacy KeyConditions if it's used,
+// so that both ways of writing a query share a cache key.
+// The conditions must be an equality on the hash key, optionally with one condition on the range key.
+func keyConditions(input *dynamodb.QueryInput, schema []*dynamodb.KeySchemaElement) (map[string]*dynamodb.Condition, error) {
+	conds := input.KeyConditions
+	if input.KeyConditionExpression != nil {
+		var err error
+		conds, err = parseKeyCondition(*input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hk, rk := hashKey(schema), rangeKey(schema)
+	hc := conds[hk]
+	if hc == nil || aws.StringValue(hc.ComparisonOperator) != dynamodb.ComparisonOperatorEq || len(hc.AttributeValueList) != 1 {
+		return nil, fmt.Errorf("%w: no equality on hash key %s", errUnsupportedKeyCondition, hk)
+	}
+	for name := range conds {
+		if name != hk && (name != rk || rk == "") {
+			return nil, fmt.Errorf("%w on %s", errUnsupportedKeyCondition, name)
+		}
+	}
+	return conds, nil
+}
+
+// parseKeyCondition parses a KeyConditionExpression: one or two conditions joined by AND,
+// each an attribute compared with =, <, <=, >, or >= to a value, BETWEEN two values,
+// or begins_with a value. Parentheses are allowed around any of them.
+func parseKeyCondition(expr string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.Condition, error) {
+	toks, err := lexKeyCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &keyCondParser{toks: toks, names: names, values: values, conds: make(map[string]*dynamodb.Condition, 2)}
+	if err := p.expr(); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedKeyCondition, p.toks[p.pos])
+	}
+	return p.conds, nil
+}
+
+type keyCondParser struct {
+	toks   []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	conds  map[string]*dynamodb.Condition
+}
+
+var keyCondOps = map[string]string{
+	"=":  dynamodb.ComparisonOperatorEq,
+	"<":  dynamodb.ComparisonOperatorLt,
+	"<=": dynamodb.ComparisonOperatorLe,
+	">":  dynamodb.ComparisonOperatorGt,
+	">=": dynamodb.ComparisonOperatorGe,
+}
+
+func (p *keyCondParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *keyCondParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *keyCondParser) expect(tok string) error {
+	if got := p.next(); !strings.EqualFold(got, tok) {
+		return fmt.Errorf("%w: expected %q, got %q", errUnsupportedKeyCondition, tok, got)
+	}
+	return nil
+}
+
+// expr parses terms joined by AND.
+func (p *keyCondParser) expr() error {
+	if err := p.term(); err != nil {
+		return err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		if err := p.term(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// term parses a parenthesized expression or a single condition.
+func (p *keyCondParser) term() error {
+	if p.peek() == "(" {
+		p.next()
+		if err := p.expr(); err != nil {
+			return err
+		}
+		return p.expect(")")
+	}
+
+	if strings.EqualFold(p.peek(), "begins_with") {
+		p.next()
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(","); err != nil {
+			return err
+		}
+		prefix, err := p.value()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		return p.add(name, dynamodb.ComparisonOperatorBeginsWith, prefix)
+	}
+
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	tok := p.next()
+	if strings.EqualFold(tok, "BETWEEN") {
+		lo, err := p.value()
+		if err != nil {
+			return err
+		}
+		if err := p.expect("AND"); err != nil {
+			return err
+		}
+		hi, err := p.value()
+		if err != nil {
+			return err
+		}
+		return p.add(name, dynamodb.ComparisonOperatorBetween, lo, hi)
+	}
+	op, ok := keyCondOps[tok]
+	if !ok {
+		return fmt.Errorf("%w: unexpected %q after %s", errUnsupportedKeyCondition, tok, name)
+	}
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	return p.add(name, op, v)
+}
+
+func (p *keyCondParser) name() (string, error) {
+	tok := p.next()
+	switch {
+	case strings.HasPrefix(tok, "#"):
+		name, ok := p.names[tok]
+		if !ok || name == nil {
+			return "", fmt.Errorf("%w: missing attribute name %s", errUnsupportedKeyCondition, tok)
+		}
+		return *name, nil
+	case tok != "" && isKeyCondWord(tok[0]):
+		return tok, nil
+	}
+	return "", fmt.Errorf("%w: expected attribute name, got %q", errUnsupportedKeyCondition, tok)
+}
+
+func (p *keyCondParser) value() (*dynamodb.AttributeValue, error) {
+	tok := p.next()
+	if !strings.HasPrefix(tok, ":") {
+		return nil, fmt.Errorf("%w: expected value, got %q", errUnsupportedKeyCondition, tok)
+	}
+	v, ok := p.values[tok]
+	if !ok || v == nil {
+		return nil, fmt.Errorf("%w: missing attribute value %s", errUnsupportedKeyCondition, tok)
+	}
+	return v, nil
+}
+
+func (p *keyCondParser) add(name, op string, values ...*dynamodb.AttributeValue) error {
+	if _, dupe := p.conds[name]; dupe {
+		return fmt.Errorf("%w: more than one condition on %s", errUnsupportedKeyCondition, name)
+	}
+	p.conds[name] = &dynamodb.Condition{
+		ComparisonOperator: aws.String(op),
+		AttributeValueList: values,
+	}
+	return nil
+}
+
+// lexKeyCondition splits a key condition expression into tokens: words (including
+// #name and :value placeholders), comparison operators, and punctuation.
+func lexKeyCondition(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case isSpace(ch):
+			i++
+		case ch == '(' || ch == ')' || ch == ',' || ch == '=':
+			toks = append(toks, expr[i:i+1])
+			i++
+		case ch == '<' || ch == '>':
+			j := i + 1
+			if j < len(expr) && (expr[j] == '=' || ch == '<' && expr[j] == '>') {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		case ch == '#' || ch == ':' || isKeyCondWord(ch):
+			j := i + 1
+			for j < len(expr) && isKeyCondWord(expr[j]) {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedKeyCondition, ch)
+		}
+	}
+	return toks, nil
+}
+
+func isKeyCondWord(ch byte) bool {
+	return ch == '_' || ch == '-' || ch == '.' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
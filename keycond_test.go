@@ -0,0 +1,123 @@
+package localcache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+var keyCondValues = map[string]*dynamodb.AttributeValue{
+	":a": {S: aws.String("a")},
+	":b": {S: aws.String("b")},
+	":c": {S: aws.String("c")},
+}
+
+func keyCond(op string, values ...string) *dynamodb.Condition {
+	cond := &dynamodb.Condition{ComparisonOperator: aws.String(op)}
+	for _, v := range values {
+		cond.AttributeValueList = append(cond.AttributeValueList, keyCondValues[v])
+	}
+	return cond
+}
+
+func TestKeyConditions(t *testing.T) {
+	tests := []struct {
+		expr string
+		sk   *dynamodb.Condition
+	}{
+		{"pk = :a", nil},
+		{"#pk = :a", nil},
+		{"pk = :a AND sk = :b", keyCond(dynamodb.ComparisonOperatorEq, ":b")},
+		{"pk = :a AND sk < :b", keyCond(dynamodb.ComparisonOperatorLt, ":b")},
+		{"pk = :a AND sk <= :b", keyCond(dynamodb.ComparisonOperatorLe, ":b")},
+		{"pk = :a AND sk > :b", keyCond(dynamodb.ComparisonOperatorGt, ":b")},
+		{"pk = :a AND sk >= :b", keyCond(dynamodb.ComparisonOperatorGe, ":b")},
+		{"pk = :a AND sk BETWEEN :b AND :c", keyCond(dynamodb.ComparisonOperatorBetween, ":b", ":c")},
+		{"pk = :a and sk between :b and :c", keyCond(dynamodb.ComparisonOperatorBetween, ":b", ":c")},
+		{"pk = :a AND begins_with(sk, :b)", keyCond(dynamodb.ComparisonOperatorBeginsWith, ":b")},
+		{"(#pk = :a) AND (begins_with(#sk, :b))", keyCond(dynamodb.ComparisonOperatorBeginsWith, ":b")},
+		{"sk>=:b AND pk=:a", keyCond(dynamodb.ComparisonOperatorGe, ":b")},
+	}
+	schema := keySchema("pk", "sk")
+	for _, test := range tests {
+		expr := &dynamodb.QueryInput{
+			TableName:                 aws.String("T"),
+			KeyConditionExpression:    aws.String(test.expr),
+			ExpressionAttributeNames:  map[string]*string{"#pk": aws.String("pk"), "#sk": aws.String("sk")},
+			ExpressionAttributeValues: keyCondValues,
+		}
+		conds, err := keyConditions(expr, schema)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		want := map[string]*dynamodb.Condition{"pk": keyCond(dynamodb.ComparisonOperatorEq, ":a")}
+		if test.sk != nil {
+			want["sk"] = test.sk
+		}
+		if !reflect.DeepEqual(conds, want) {
+			t.Errorf("%s: got %v, want %v", test.expr, conds, want)
+		}
+
+		// the same query written with legacy KeyConditions shares its cache key
+		legacy := &dynamodb.QueryInput{TableName: aws.String("T"), KeyConditions: want}
+		legacyConds, err := keyConditions(legacy, schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := queryKey(expr, schema, conds), queryKey(legacy, schema, legacyConds); got != want {
+			t.Errorf("%s: key %q differs from legacy key %q", test.expr, got, want)
+		}
+	}
+}
+
+func TestUnsupportedKeyConditions(t *testing.T) {
+	exprs := []string{
+		"sk = :b",
+		"pk < :a",
+		"pk = :a OR sk = :b",
+		"pk = :a AND v = :c",
+		"pk = :a AND sk = :b AND sk = :c",
+		"pk = :a AND sk <> :b",
+		"pk IN (:a, :b)",
+		"pk = :missing",
+		"#missing = :a",
+		"pk = :a AND (sk = :b",
+		"pk = :a; DROP",
+	}
+	for _, expr := range exprs {
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String("T"),
+			KeyConditionExpression:    aws.String(expr),
+			ExpressionAttributeValues: keyCondValues,
+		}
+		if _, err := keyConditions(input, keySchema("pk", "sk")); !errors.Is(err, errUnsupportedKeyCondition) {
+			t.Errorf("%s: got error %v", expr, err)
+		}
+	}
+}
+
+// TestQueryUnsupportedKeyCondition checks that queries the cache can't key
+// pass through without counting as degraded.
+func TestQueryUnsupportedKeyCondition(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String("T"),
+		KeyConditionExpression:    aws.String("pk = :a AND sk <> :b"),
+		ExpressionAttributeValues: keyCondValues,
+	}
+	for i := 0; i < 2; i++ {
+		c.QueryWithContext(ctx, input)
+	}
+	if got := f.count("Query"); got != 2 {
+		t.Errorf("Query called %d times, want 2", got)
+	}
+	if got := c.Stats().Degradations; got != 0 {
+		t.Errorf("counted %d degradations", got)
+	}
+}
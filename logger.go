@@ -0,0 +1,67 @@
+package localcache
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Logger receives the cache's debug log, see WithLogger.
+type Logger interface {
+	Log(entry LogEntry)
+}
+
+// LogEntry is a line of the cache's debug log.
+type LogEntry struct {
+	// Op is the operation being served, such as "GetItem".
+	// It is empty for work not done on behalf of a single call, such as pressure checks.
+	Op string
+	// Table is the table involved, if any.
+	Table string
+	// Key is the cache key involved, if any.
+	Key string
+	// Msg says what happened, such as "hit", "miss", or "caching".
+	Msg string
+	// TTL is how long an entry is being cached for, if it is.
+	TTL time.Duration
+	// Args holds anything else relevant, such as an error.
+	Args []interface{}
+}
+
+// String formats the entry the way the default logger prints it.
+func (e LogEntry) String() string {
+	var b strings.Builder
+	if e.Op != "" {
+		b.WriteString(e.Op)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Msg)
+	if e.Table != "" {
+		b.WriteString(" table=")
+		b.WriteString(e.Table)
+	}
+	if e.Key != "" {
+		b.WriteString(" key=")
+		b.WriteString(e.Key)
+	}
+	if e.TTL != 0 {
+		b.WriteString(" ttl=")
+		b.WriteString(e.TTL.String())
+	}
+	for _, arg := range e.Args {
+		b.WriteByte(' ')
+		fmt.Fprint(&b, arg)
+	}
+	return b.String()
+}
+
+// log writes e to the Logger, if there is one, or else to the standard logger if Debug is on.
+func (c *Cache) log(e LogEntry) {
+	switch {
+	case c.logger != nil:
+		c.logger.Log(e)
+	case c.Debug:
+		log.Println("localcache:", e)
+	}
+}
@@ -0,0 +1,144 @@
+package localcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru is a simple Backend that evicts the least recently used entries
+// once it holds more than its size.
+type lru struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[string]map[string]*list.Element
+}
+
+type lruEntry struct {
+	primary   string
+	secondary string
+	value     interface{}
+	expires   time.Time
+}
+
+func (e *lruEntry) Value() interface{} {
+	return e.value
+}
+
+func (e *lruEntry) Expired() bool {
+	return time.Now().After(e.expires)
+}
+
+func (e *lruEntry) TTL() time.Duration {
+	return time.Until(e.expires)
+}
+
+// NewLRU returns an in-memory Backend holding at most size entries,
+// evicting the least recently used ones first. It has no background goroutines
+// and no dependencies beyond the standard library. It panics if size isn't positive.
+func NewLRU(size int) Backend {
+	if size <= 0 {
+		panic("localcache: NewLRU: size must be positive")
+	}
+	return &lru{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]map[string]*list.Element),
+	}
+}
+
+func (l *lru) Get(primary, secondary string) Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.entries[primary][secondary]
+	if !ok {
+		return nil
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry)
+}
+
+func (l *lru) Peek(primary, secondary string) Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.entries[primary][secondary]
+	if !ok {
+		return nil
+	}
+	return elem.Value.(*lruEntry)
+}
+
+func (l *lru) Set(primary, secondary string, value interface{}, ttl time.Duration) {
+	// entries are never modified once stored, so callers can read them without the lock
+	entry := &lruEntry{
+		primary:   primary,
+		secondary: secondary,
+		value:     value,
+		expires:   time.Now().Add(ttl),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.entries[primary]
+	if bucket == nil {
+		bucket = make(map[string]*list.Element)
+		l.entries[primary] = bucket
+	}
+	if elem, ok := bucket[secondary]; ok {
+		l.order.Remove(elem)
+	}
+	bucket[secondary] = l.order.PushFront(entry)
+	for l.order.Len() > l.size {
+		l.remove(l.order.Back())
+	}
+}
+
+func (l *lru) Delete(primary, secondary string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.entries[primary][secondary]
+	if !ok {
+		return false
+	}
+	l.remove(elem)
+	return true
+}
+
+func (l *lru) DeleteAll(primary string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.entries[primary]
+	if !ok {
+		return false
+	}
+	for _, elem := range bucket {
+		l.order.Remove(elem)
+	}
+	delete(l.entries, primary)
+	return true
+}
+
+func (l *lru) ItemCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+func (l *lru) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order.Init()
+	l.entries = make(map[string]map[string]*list.Element)
+}
+
+func (l *lru) Stop() {}
+
+// remove drops elem. The caller must hold the lock.
+func (l *lru) remove(elem *list.Element) {
+	entry := l.order.Remove(elem).(*lruEntry)
+	bucket := l.entries[entry.primary]
+	delete(bucket, entry.secondary)
+	if len(bucket) == 0 {
+		delete(l.entries, entry.primary)
+	}
+}
@@ -0,0 +1,32 @@
+package localcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(2)
+	l.Set("a", "1", 1, time.Minute)
+	l.Set("a", "2", 2, time.Minute)
+	l.Get("a", "1")
+	l.Set("b", "1", 3, time.Minute)
+	if l.Peek("a", "2") != nil {
+		t.Error("least recently used entry not evicted")
+	}
+	if l.Peek("a", "1") == nil || l.Peek("b", "1") == nil {
+		t.Error("recently used entries evicted")
+	}
+	if !l.DeleteAll("a") || l.ItemCount() != 1 {
+		t.Errorf("DeleteAll left %d entries, want 1", l.ItemCount())
+	}
+}
+
+func TestLRUSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewLRU(0) didn't panic")
+		}
+	}()
+	NewLRU(0)
+}
@@ -0,0 +1,575 @@
+package localcache
+
+import (
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/karlseguin/ccache"
+)
+
+// Option configures a Cache. Options are passed to NewWithDB.
+type Option func(*Cache)
+
+// WithMaxKeyLength caps the length of cache keys. Keys longer than n bytes are
+// replaced by their SHA-256 hash, which bounds per-entry key memory for tables
+// with huge composite keys. Shorter keys are left as-is.
+// By default, keys are unbounded.
+func WithMaxKeyLength(n int) Option {
+	return func(c *Cache) {
+		c.maxKeyLen = n
+	}
+}
+
+// WithMaxCachedItemBytes skips caching items larger than n bytes, estimated the way
+// DynamoDB measures item size. A few items near the 400KB limit can otherwise
+// crowd out many small, frequently read ones. By default, items of any size are cached.
+func WithMaxCachedItemBytes(n int) Option {
+	return func(c *Cache) {
+		c.maxItemBytes = n
+	}
+}
+
+// WithAdmissionPolicy sets a policy deciding which items read from DynamoDB after a miss
+// (by GetItem or BatchGetItem) are cached, such as NewRecurringMissPolicy. Items that are
+// rarely read twice then don't evict ones that are, which can improve the hit ratio of
+// skewed workloads without growing the cache. Writes, warming, and refreshes cache items regardless.
+func WithAdmissionPolicy(p AdmissionPolicy) Option {
+	return func(c *Cache) {
+		c.admission = p
+	}
+}
+
+// WithCacheTransform sets a function applied to items before they are cached, such as to
+// redact attributes that shouldn't linger in memory. It returns the item to cache, or nil
+// to not cache it at all. It must not modify the item it's given, which is also returned
+// to the caller: copy it instead.
+//
+// Only cached copies are transformed, so the read or write that caches an item returns it
+// as DynamoDB did, but later reads served from the cache return the transformed item.
+// The transform applies to the item, projection, and GSI item caches; query and scan
+// results are cached as returned, so bypass them with WithCachePolicy if that matters.
+// Cached items are also used to find the index partitions a write invalidates, so the
+// transformed item must keep the key attributes of the table and its indexes.
+func WithCacheTransform(fn func(table string, item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue) Option {
+	return func(c *Cache) {
+		c.transformFn = fn
+	}
+}
+
+// WithItemTTL sets how long items from GetItem, BatchGetItem, and writes are cached.
+// The default is 15 minutes.
+//
+// Unless overridden by WithQueryTTL or WithScanTTL, query and scan results
+// are cached for the same duration. Keeping them equal avoids a query result
+// outliving the items it returned (or vice versa), which can make the two
+// caches disagree about the same item for longer than either TTL suggests.
+func WithItemTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.itemTTL.Store(int64(ttl))
+	}
+}
+
+// WithQueryTTL sets how long query results are cached.
+// It defaults to the item TTL, see WithItemTTL.
+func WithQueryTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.queryTTL.Store(int64(ttl))
+	}
+}
+
+// WithScanTTL sets how long scan results are cached.
+// It defaults to the item TTL, see WithItemTTL.
+func WithScanTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.scanTTL.Store(int64(ttl))
+	}
+}
+
+// DontCache is a TTL that keeps a query's results out of the cache, see WithQueryTTLFunc.
+const DontCache time.Duration = math.MinInt64
+
+// WithQueryTTLFunc sets a function choosing how long each query's results are cached,
+// so that queries for fast-changing results (such as recent activity) can be cached
+// for less time than stable lookups. Returning DontCache doesn't cache the results at all,
+// and zero or any other negative duration uses the usual TTL (see WithQueryTTL and WithEmptyResultTTL).
+func WithQueryTTLFunc(fn func(*dynamodb.QueryInput) time.Duration) Option {
+	return func(c *Cache) {
+		c.queryTTLFunc = fn
+	}
+}
+
+// WithItemCacheConfig sets the ccache configuration for the item cache.
+func WithItemCacheConfig(cfg *ccache.Configuration) Option {
+	return func(c *Cache) {
+		c.itemConfig = cfg
+	}
+}
+
+// WithQueryCacheConfig sets the ccache configuration for the query cache.
+func WithQueryCacheConfig(cfg *ccache.Configuration) Option {
+	return func(c *Cache) {
+		c.queryConfig = cfg
+	}
+}
+
+// WithScanCacheConfig sets the ccache configuration for the scan cache.
+func WithScanCacheConfig(cfg *ccache.Configuration) Option {
+	return func(c *Cache) {
+		c.scanConfig = cfg
+	}
+}
+
+// WithQueryCacheSize caps the number of cached query results, overriding the MaxSize
+// of the query cache configuration (see WithQueryCacheConfig) without modifying it.
+//
+// The cap applies to results across all query partitions, not to the number of
+// partitions: when the cache is full, the least recently used results are evicted
+// regardless of which partition they're in, so many cold partitions can't crowd out
+// a few hot ones. ccache evicts in batches once the cap is exceeded (see ItemsToPrune),
+// so it can briefly hold a few more. The cap only applies to the default backend,
+// see WithBackend.
+func WithQueryCacheSize(size int64) Option {
+	return func(c *Cache) {
+		c.querySize = size
+	}
+}
+
+// WithItemsToPrune sets how many entries the item, query, and scan caches evict at a time
+// once they're full (ccache's ItemsToPrune, 500 by default). Like the options below,
+// it overrides the setting in each of their ccache configurations without modifying them,
+// and only applies to the default backend, see WithBackend.
+func WithItemsToPrune(n uint32) Option {
+	return func(c *Cache) {
+		c.tuning = append(c.tuning, func(cfg *ccache.Configuration) { cfg.ItemsToPrune(n) })
+	}
+}
+
+// WithGetsPerPromote sets how many times an entry must be read before it's promoted
+// in the caches' LRU lists (ccache's GetsPerPromote, 3 by default).
+// Lower values track recency more closely, at the cost of more promotions.
+func WithGetsPerPromote(n int32) Option {
+	return func(c *Cache) {
+		c.tuning = append(c.tuning, func(cfg *ccache.Configuration) { cfg.GetsPerPromote(n) })
+	}
+}
+
+// WithPromoteBuffer sets the size of the caches' queues of entries waiting to be promoted
+// (ccache's PromoteBuffer, 1024 by default). Promotions are skipped while a queue is full.
+func WithPromoteBuffer(n uint32) Option {
+	return func(c *Cache) {
+		c.tuning = append(c.tuning, func(cfg *ccache.Configuration) { cfg.PromoteBuffer(n) })
+	}
+}
+
+// WithShards splits each of the cache's backends into n shards, spreading entries between
+// them by key (see WithSharder). This is meant for backends shared between
+// processes, such as a cluster of remote caches. Each shard is created by fn with the
+// backend's name and the shard's index, or as usual (see WithBackend) if fn is nil or returns nil.
+// Note that each default shard is as large as the configured cache.
+func WithShards(n int, fn func(name string, shard int) Backend) Option {
+	return func(c *Cache) {
+		c.shards = n
+		c.newShardFn = fn
+	}
+}
+
+// WithSharder sets the function choosing the shard for a key, see WithShards.
+// Items and GSI items are sharded by item key, so a table's items spread over every shard.
+// Projections are sharded by item key too, queries by partition, and scans by table
+// (or index, see WithIndexScopedScanCache).
+// It should return an index between 0 and the number of shards; other results wrap around.
+// The default is a simple hash modulo the number of shards, which moves most keys when
+// shards are added. Use consistent hashing (such as rendezvous hashing) to avoid that.
+func WithSharder(fn func(key string) int) Option {
+	return func(c *Cache) {
+		c.sharder = fn
+	}
+}
+
+// WithDescCacheConfig sets the ccache configuration for the table description cache.
+// It has no effect with WithSharedDescCache.
+func WithDescCacheConfig(cfg *ccache.Configuration) Option {
+	return func(c *Cache) {
+		c.descConfig = cfg
+	}
+}
+
+// WithBackend sets the function used to create the cache's backends, in place of ccache.
+// It is called once per backend with its name, such as BackendItems or BackendQueries,
+// and may return nil to use the default for that one. The ccache configuration options
+// only apply to default backends.
+//
+// Cache keys are made of table names and item keys alone, because a Cache only talks
+// to one region. A backend shared between caches for different regions or endpoints
+// would mix up their tables, so give each its own.
+func WithBackend(fn func(name string) Backend) Option {
+	return func(c *Cache) {
+		c.newBackendFn = fn
+	}
+}
+
+// WithIndexScopedScanCache caches scans of indexes separately from scans of their tables,
+// so that writes to a table only invalidate its table scans and the scans of the indexes
+// the written items are (or were) in. This suits tables with sparse indexes, which most
+// writes don't touch.
+func WithIndexScopedScanCache() Option {
+	return func(c *Cache) {
+		c.indexScopedScans = true
+	}
+}
+
+// WithMaxScansPerTable limits how many distinct scans are cached per table
+// (or per index, with WithIndexScopedScanCache), evicting the least recently used
+// scan of the table to make room for a new one. This keeps tables scanned with
+// many one-off filters from crowding out the scans that are actually repeated.
+// Cached PartiQL SELECTs count towards their table's limit as well.
+//
+// The limit is enforced on top of the scan cache's ccache configuration (see WithScanCacheConfig),
+// which still evicts entries on its own when the cache as a whole is full.
+// Entries evicted that way keep counting towards the limit until they're pushed out by newer scans,
+// so a table may have fewer than n scans cached, but never more.
+func WithMaxScansPerTable(n int) Option {
+	return func(c *Cache) {
+		if n > 0 {
+			c.scanLimit = newScanLimit(n)
+		}
+	}
+}
+
+// WithCachePolicy sets a function deciding, per read, whether to use the cache,
+// bypass it, or refresh it (see Decision). It is called with the request's context,
+// the name of the operation ("GetItem", "BatchGetItem", "Query", or "Scan"),
+// and the table, so reads can be steered by context the input doesn't carry,
+// such as "this read must never be stale". For BatchGetItem, it is called once per table.
+// It must be safe for concurrent use.
+func WithCachePolicy(policy func(ctx aws.Context, op, table string) Decision) Option {
+	return func(c *Cache) {
+		c.policy = policy
+	}
+}
+
+// WithInvalidatedIndexes limits which of table's indexes are invalidated on writes,
+// which saves work on write-heavy tables with many indexes that are rarely queried.
+// Queries against the table's other indexes are neither cached nor invalidated:
+// they pass straight through to DynamoDB. Queries against the table itself are unaffected.
+// It can be given multiple times, adding to the indexes of each table.
+func WithInvalidatedIndexes(table string, indexes ...string) Option {
+	return func(c *Cache) {
+		if c.cachedIndexes == nil {
+			c.cachedIndexes = make(map[string]map[string]struct{})
+		}
+		set := c.cachedIndexes[table]
+		if set == nil {
+			set = make(map[string]struct{}, len(indexes))
+			c.cachedIndexes[table] = set
+		}
+		for _, index := range indexes {
+			set[index] = struct{}{}
+		}
+	}
+}
+
+// WithLocalProjection serves projected GetItem requests from the full item, if it's cached,
+// by applying the projection locally instead of asking DynamoDB. Projections that index
+// into lists are still sent to DynamoDB.
+func WithLocalProjection() Option {
+	return func(c *Cache) {
+		c.localProjection = true
+	}
+}
+
+// WithWarmup describes the given tables in the background as soon as the cache is created,
+// see Warmup. Errors are reported to the error handler, see WithErrorHandler.
+// Use Flush to wait for it to finish.
+func WithWarmup(tables ...string) Option {
+	return func(c *Cache) {
+		c.warmTables = append(c.warmTables, tables...)
+	}
+}
+
+// WithKeyTiming counts the cache keys built for GetItem, BatchGetItem, Query, and Scan,
+// and the time spent building them, in Stats. It's off by default, since timing
+// every key costs more than building most of them.
+func WithKeyTiming() Option {
+	return func(c *Cache) {
+		c.keyTiming = true
+	}
+}
+
+// WithDryRun runs the cache in shadow mode: reads look up and fill the cache as usual,
+// and writes update and invalidate it, but every read is sent to DynamoDB and its
+// live result returned. Would-be hits don't refill the cache, so an entry ages
+// and expires just as it would when served. Each lookup is logged as a would-be hit or miss, and counted
+// towards HitRatio and Stats, so key building and hit rates can be checked in production
+// before serving from the cache for real.
+func WithDryRun() Option {
+	return func(c *Cache) {
+		c.dryRun = true
+	}
+}
+
+// WithBatchPutPrefetch makes BatchWriteItem read the items its puts will overwrite, in tables
+// with global secondary indexes, so the query partitions the old items are leaving are
+// invalidated too. Otherwise, cached queries against an index partition an item was
+// moved out of keep returning it until they expire. Deletes are always prefetched.
+// Items already in the cache aren't read again.
+func WithBatchPutPrefetch() Option {
+	return func(c *Cache) {
+		c.batchPutPrefetch = true
+	}
+}
+
+// WithNoInputMutation keeps PutItem, DeleteItem and UpdateItem from setting ReturnValues on their
+// inputs. By default, they ask DynamoDB for the old or new item, to find the query partitions the
+// write invalidates and (for updates) to cache the new item. PutItem only asks in tables with
+// global secondary indexes, whose partitions the overwritten item may have been in
+// (or with WithIndexScopedScanCache, any indexes).
+// With this option, the cache reads the item
+// before writing it instead, costing an extra read per write unless the item is already cached,
+// and updated items are dropped from the cache rather than refreshed. Updates of index keys
+// drop every cached query of the table, since the item's new index partitions aren't known.
+// Callers that set ReturnValues themselves still get the benefit of it.
+func WithNoInputMutation() Option {
+	return func(c *Cache) {
+		c.noInputMutation = true
+	}
+}
+
+// WithPrefetchConsistency sets whether the reads of old items made before writes, to find
+// the query partitions they're leaving, are strongly consistent. By default they are,
+// which costs twice as much capacity as eventually consistent reads but never misses
+// a recent change. With no tables given, it sets the default for all tables.
+// Otherwise it applies to the given tables only, taking precedence over the default.
+func WithPrefetchConsistency(consistent bool, tables ...string) Option {
+	return func(c *Cache) {
+		if len(tables) == 0 {
+			c.prefetchEventual = !consistent
+			return
+		}
+		if c.prefetchConsistency == nil {
+			c.prefetchConsistency = make(map[string]bool, len(tables))
+		}
+		for _, table := range tables {
+			c.prefetchConsistency[table] = consistent
+		}
+	}
+}
+
+// WithInvalidationPublisher sets a function called with the key of every item invalidated
+// by a write, such as to publish it to a message queue so that other instances can apply it
+// with InvalidateItem. It is called in the background once the write's own invalidation is
+// done, so it can't slow down or fail the write. See WithSyncInvalidationPublisher
+// to call it before the write returns instead.
+func WithInvalidationPublisher(fn func(table string, key map[string]*dynamodb.AttributeValue)) Option {
+	return func(c *Cache) {
+		c.publisher = &invalidationPublisher{fn: fn}
+	}
+}
+
+// WithSyncInvalidationPublisher is like WithInvalidationPublisher, but calls fn
+// before the write returns, which will wait for it.
+func WithSyncInvalidationPublisher(fn func(table string, key map[string]*dynamodb.AttributeValue)) Option {
+	return func(c *Cache) {
+		c.publisher = &invalidationPublisher{fn: fn, sync: true}
+	}
+}
+
+// WithDenyList excludes the given tables from caching: requests against them pass
+// straight through to DynamoDB. The deny list wins over the allow list (see Cache.Allow),
+// so it can be used to cache every table except a few volatile ones.
+func WithDenyList(tables ...string) Option {
+	return func(c *Cache) {
+		for _, table := range tables {
+			c.deniedTables[table] = struct{}{}
+		}
+	}
+}
+
+// WithoutLimitedFilterScans disables caching of scans that use both Limit and FilterExpression.
+// Because Limit applies before the filter, these are the most sensitive to staleness.
+func WithoutLimitedFilterScans() Option {
+	return func(c *Cache) {
+		c.skipLimitedFilterScans = true
+	}
+}
+
+// WithErrorHandler sets a function to be called with errors that can't be returned to a caller,
+// such as failures during invalidation after a successful write or in background work.
+// It may be called concurrently from multiple goroutines.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *Cache) {
+		c.onError = fn
+	}
+}
+
+// WithLogger sends the cache's debug log to l, whether or not Debug is on.
+// Without a Logger, the log goes to the standard logger when Debug is on.
+// It may be called concurrently from multiple goroutines.
+func WithLogger(l Logger) Option {
+	return func(c *Cache) {
+		c.logger = l
+	}
+}
+
+// WithTraceHook calls fn for every cache lookup with the request's context, so that
+// cache behavior can be recorded in distributed traces, such as by adding
+// attributes to the span in ctx. Cache keys are only included when Debug is on,
+// since they can contain sensitive values. See TraceHook.
+func WithTraceHook(fn TraceHook) Option {
+	return func(c *Cache) {
+		c.traceHook = fn
+	}
+}
+
+// WithGSIItemCache enables caching the items returned by global secondary index queries,
+// keyed by their index key and primary key.
+// These items only contain the index's projected attributes, so they are kept
+// separate from the main item cache and are never returned by GetItem;
+// they only serve lookups scoped to the same index, see Cache.IndexItem.
+// The GSI item cache shares the query cache's configuration and TTL.
+func WithGSIItemCache() Option {
+	return func(c *Cache) {
+		c.gsiItemCache = true
+	}
+}
+
+// WithReadOnly makes the cache reject writes (PutItem, UpdateItem, DeleteItem,
+// BatchWriteItem, and TransactWriteItems) with ErrReadOnly instead of sending them to DynamoDB.
+// Use this for read replicas that should never write, to catch accidental writes.
+func WithReadOnly() Option {
+	return func(c *Cache) {
+		c.readOnly = true
+	}
+}
+
+// WithPressureHandler watches the item cache for eviction pressure.
+// Every interval, it estimates how many items were evicted to make room
+// for others, and calls fn if more than threshold were. If fn is nil,
+// pressure is only logged when Debug is on.
+// Frequent pressure means the cache is too small for its working set,
+// and its size should be raised or TTLs lowered before the hit ratio suffers.
+// The watcher is stopped by Close. Intervals of zero or less are ignored.
+func WithPressureHandler(interval time.Duration, threshold int, fn func(evicted int)) Option {
+	return func(c *Cache) {
+		if interval <= 0 {
+			return
+		}
+		c.pressure = &pressureWatcher{
+			interval:  interval,
+			threshold: threshold,
+			fn:        fn,
+		}
+	}
+}
+
+// WithStatsInterval calls fn with a snapshot of the cache's stats (see Cache.Stats) every interval,
+// such as to log them or export them as metrics. Stats are cumulative, so fn can compute
+// rates by keeping the previous snapshot. The ticker is stopped by Close.
+func WithStatsInterval(interval time.Duration, fn func(Stats)) Option {
+	return func(c *Cache) {
+		c.statsInterval = interval
+		c.statsFn = fn
+	}
+}
+
+// WithItemTTLAttribute sets the name of the attribute tables use for DynamoDB's
+// Time to Live feature, holding a Unix epoch timestamp in seconds.
+// Items are cached until they expire or for the item TTL, whichever comes first.
+// Items that have already expired aren't cached.
+func WithItemTTLAttribute(name string) Option {
+	return func(c *Cache) {
+		c.ttlAttr = name
+	}
+}
+
+// WithSoftDeleteAttribute sets the name of an attribute marking items as deleted without
+// actually deleting them. Items with it set to true, a nonzero number, or a non-empty string
+// are returned by GetItem and BatchGetItem as if they didn't exist, whether they're read from
+// the cache or from DynamoDB. They're still cached, for the negative TTL (see WithNegativeTTL),
+// so that reads of deleted items are served from the cache like those of missing ones.
+//
+// Query and scan results are cached as returned: filter deleted items out of them yourself,
+// such as with a FilterExpression. Projected reads only see the mark if they project it.
+func WithSoftDeleteAttribute(name string) Option {
+	return func(c *Cache) {
+		c.softDeleteAttr = name
+	}
+}
+
+// WithNegativeTTL sets how long the absence of an item is cached,
+// after a GetItem, BatchGetItem, or delete finds nothing there.
+// It defaults to the item TTL.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.negativeTTL = ttl
+	}
+}
+
+// WithEmptyResultTTL sets how long query and scan results without any items are cached.
+// Empty results often fill up soon, so it's useful to give them a shorter TTL.
+// It defaults to the query or scan TTL.
+func WithEmptyResultTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		c.emptyResultTTL = ttl
+	}
+}
+
+// WithTTLJitter randomly shortens item TTLs by up to the given fractions (between 0 and 1),
+// so that items cached at the same time don't all expire at once.
+// Positive applies to cached items, and negative to cached absences of items (see WithNegativeTTL).
+// Negative entries tend to be cached in bursts of misses for keys that still won't exist
+// when they expire, so jittering them keeps the re-checks from all hitting DynamoDB together.
+// Fractions outside of that range are clamped to it.
+func WithTTLJitter(positive, negative float64) Option {
+	return func(c *Cache) {
+		c.jitter = min(max(positive, 0), 1)
+		c.negativeJitter = min(max(negative, 0), 1)
+	}
+}
+
+// WithServeStaleOnError makes GetItem return an expired cached item, instead of an error,
+// when reading it from DynamoDB fails (such as from throttling or timeouts during an outage).
+// Only items that expired less than an hour ago are served, see WithStaleGrace;
+// invalidated items never are.
+// Expired items linger only until they are evicted, so this is best effort.
+// Stale reads are counted in Stats.StaleServed.
+func WithServeStaleOnError() Option {
+	return func(c *Cache) {
+		c.serveStale = true
+	}
+}
+
+// WithStaleGrace sets how long after expiring items can still be served by WithServeStaleOnError.
+// The default is an hour. Graces of zero or less are ignored.
+func WithStaleGrace(grace time.Duration) Option {
+	return func(c *Cache) {
+		if grace <= 0 {
+			return
+		}
+		c.staleGrace = grace
+	}
+}
+
+// WithDescTTL sets how long table descriptions are cached. The default is 24 hours.
+// Descriptions are how the cache knows tables' key schemas and indexes, so while they
+// change often (such as during development) a shorter TTL keeps invalidation accurate.
+// With a shared DescCache, each cache uses its own TTL for the descriptions it fetches.
+// TTLs of zero or less are ignored.
+func WithDescTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		if ttl <= 0 {
+			return
+		}
+		c.descTTL = ttl
+	}
+}
+
+// WithSharedDescCache makes the cache use the given table description cache,
+// which may be shared with other caches. Purging or closing the cache won't affect it.
+func WithSharedDescCache(shared *DescCache) Option {
+	return func(c *Cache) {
+		c.tableDesc = shared
+	}
+}
@@ -0,0 +1,268 @@
+package localcache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// PartiQL SELECT results are cached in the scan cache, under their table:
+// a statement can return any of the table's items, so like a scan, any write to
+// the table invalidates it. Other statements write to the table, and since the
+// written items aren't known, they invalidate everything cached for it.
+
+func (c *Cache) ExecuteStatementWithContext(ctx aws.Context, input *dynamodb.ExecuteStatementInput, opts ...request.Option) (*dynamodb.ExecuteStatementOutput, error) {
+	if !c.Enabled() || input.Statement == nil {
+		return c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	}
+	verb, table := statementTarget(*input.Statement)
+	if verb != "SELECT" {
+		return c.executeWrite(ctx, input, table, opts...)
+	}
+	if table == "" || !c.isAllowed(table) {
+		return c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	}
+	decision := c.decide(ctx, "ExecuteStatement", table)
+	if decision == Bypass {
+		return c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	}
+	// a cached result can't satisfy a strongly consistent read
+	if aws.BoolValue(input.ConsistentRead) {
+		return c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	}
+
+	key := statementKey(input)
+	if decision == Refresh {
+		c.deleteScan(table, key)
+	}
+	cached, ok := c.getScan(table, key)
+	if c.lookup(ctx, ok, LogEntry{Op: "ExecuteStatement", Table: table, Key: key}) {
+		return cachedStatement(cached.(*dynamodb.ExecuteStatementOutput), table, input), nil
+	}
+
+	start := time.Now()
+	out, err := c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	c.timeBackend(start)
+	if err != nil {
+		c.recordError(table, err)
+		return out, err
+	}
+	// a dry run hit stays as it was
+	if !ok {
+		c.setStatement(table, key, cacheableStatement(out))
+	}
+	return out, err
+}
+
+// executeWrite runs a statement that isn't a SELECT, then drops everything cached for its table.
+// If the table can't be determined, the whole cache is purged instead.
+func (c *Cache) executeWrite(ctx aws.Context, input *dynamodb.ExecuteStatementInput, table string, opts ...request.Option) (*dynamodb.ExecuteStatementOutput, error) {
+	if c.readOnly {
+		return nil, ErrReadOnly
+	}
+	if table != "" && !c.isAllowed(table) {
+		return c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	}
+	out, err := c.DynamoDB.ExecuteStatementWithContext(ctx, input, opts...)
+	if err != nil {
+		if table != "" {
+			c.recordError(table, err)
+		}
+		return out, err
+	}
+	if table == "" {
+		c.log(LogEntry{Op: "ExecuteStatement", Msg: "purging after statement", Args: []interface{}{*input.Statement}})
+		c.PurgeAll()
+		return out, err
+	}
+	c.log(LogEntry{Op: "ExecuteStatement", Table: table, Msg: "invalidating after statement"})
+	// bump the table's epoch first, so reads in flight don't refill what's dropped below
+	c.invalidateTable(ctx, table, opts...)
+	c.dropItems(table)
+	return out, err
+}
+
+func (c *Cache) setStatement(table, key string, out *dynamodb.ExecuteStatementOutput) {
+	ttl := time.Duration(c.scanTTL.Load())
+	if len(out.Items) == 0 && c.emptyResultTTL > 0 {
+		ttl = c.emptyResultTTL
+	}
+	c.log(LogEntry{Op: "ExecuteStatement", Table: table, Key: key, Msg: "caching", TTL: ttl})
+	c.scans.Set(c.cacheKey(table), c.cacheKey(key), out, ttl)
+	c.sizes.scans.add(key, out)
+	c.trackScan(table, key)
+}
+
+// cacheableStatement is cacheableQuery for statements.
+func cacheableStatement(out *dynamodb.ExecuteStatementOutput) *dynamodb.ExecuteStatementOutput {
+	cp := *out
+	cp.ConsumedCapacity = nil
+	return &cp
+}
+
+// cachedStatement is cachedQuery for statements.
+func cachedStatement(out *dynamodb.ExecuteStatementOutput, table string, input *dynamodb.ExecuteStatementInput) *dynamodb.ExecuteStatementOutput {
+	cp := *out
+	cp.ConsumedCapacity = cachedCapacity(table, input.ReturnConsumedCapacity)
+	return &cp
+}
+
+// statementKey identifies a SELECT statement in the scan cache.
+// The prefix keeps it apart from scan keys, which start with the Select mode or '*'.
+func statementKey(input *dynamodb.ExecuteStatementInput) string {
+	var key strings.Builder
+	key.WriteString("partiql:")
+	key.WriteString(normalizeStatement(*input.Statement))
+	for _, param := range input.Parameters {
+		key.WriteByte('`')
+		writeAV(&key, param)
+	}
+	if input.NextToken != nil {
+		key.WriteByte('@')
+		key.WriteString(*input.NextToken)
+	}
+	if input.Limit != nil {
+		key.WriteByte('|')
+		key.WriteString(strconv.FormatInt(*input.Limit, 10))
+	}
+	return key.String()
+}
+
+// normalizeStatement collapses runs of whitespace outside of quotes into single spaces,
+// so that statements differing only in formatting share a cache entry.
+func normalizeStatement(stmt string) string {
+	var b strings.Builder
+	var quote byte
+	space := false
+	for i := 0; i < len(stmt); i++ {
+		ch := stmt[i]
+		switch {
+		case quote != 0:
+			// a doubled quote is an escaped one, which this handles as closing and reopening
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case isSpace(ch):
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\f' || ch == '\v'
+}
+
+// statementTarget returns a statement's leading keyword, upper-cased, and the table it targets.
+// The table is empty if it can't be determined. Statements against an index name it
+// as "table"."index", which is cached and invalidated along with the table.
+func statementTarget(stmt string) (verb, table string) {
+	toks := lexStatement(stmt)
+	if len(toks) == 0 || toks[0].kind != tokWord {
+		return "", ""
+	}
+	verb = strings.ToUpper(toks[0].text)
+	at := -1
+	switch verb {
+	case "SELECT", "DELETE":
+		at = findKeyword(toks, "FROM")
+	case "INSERT":
+		at = findKeyword(toks, "INTO")
+	case "UPDATE":
+		at = 0
+	}
+	if at < 0 || at+1 >= len(toks) || !toks[at+1].isName() {
+		return verb, ""
+	}
+	return verb, toks[at+1].text
+}
+
+func findKeyword(toks []token, keyword string) int {
+	for i, tok := range toks {
+		if tok.kind == tokWord && strings.EqualFold(tok.text, keyword) {
+			return i
+		}
+	}
+	return -1
+}
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // unquoted identifier or keyword
+	tokName                    // "quoted identifier"
+	tokString                  // 'string literal'
+	tokPunct                   // anything else, one byte at a time
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func (t token) isName() bool {
+	return t.kind == tokWord || t.kind == tokName
+}
+
+// lexStatement splits a PartiQL statement into tokens, just enough to find its target.
+func lexStatement(stmt string) []token {
+	var toks []token
+	for i := 0; i < len(stmt); {
+		ch := stmt[i]
+		switch {
+		case isSpace(ch):
+			i++
+		case ch == '"' || ch == '\'':
+			var text strings.Builder
+			j := i + 1
+			for j < len(stmt) {
+				if stmt[j] == ch {
+					if j+1 < len(stmt) && stmt[j+1] == ch {
+						text.WriteByte(ch)
+						j += 2
+						continue
+					}
+					break
+				}
+				text.WriteByte(stmt[j])
+				j++
+			}
+			kind := tokName
+			if ch == '\'' {
+				kind = tokString
+			}
+			toks = append(toks, token{kind: kind, text: text.String()})
+			i = j + 1
+		case isWordByte(ch):
+			j := i
+			for j < len(stmt) && isWordByte(stmt[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tokWord, text: stmt[i:j]})
+			i = j
+		default:
+			toks = append(toks, token{kind: tokPunct, text: stmt[i : i+1]})
+			i++
+		}
+	}
+	return toks
+}
+
+// isWordByte reports whether ch can be part of an unquoted identifier.
+// Table names may also contain '-', which PartiQL requires quoting, but
+// accepting it here does no harm.
+func isWordByte(ch byte) bool {
+	return ch == '_' || ch == '-' || ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
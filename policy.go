@@ -0,0 +1,48 @@
+package localcache
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Decision is what a cache policy decides to do with a read, see WithCachePolicy.
+type Decision int
+
+const (
+	// Use serves the read from the cache if possible, and caches the result otherwise.
+	// It's the default.
+	Use Decision = iota
+	// Bypass sends the read straight to DynamoDB, without reading or writing the cache.
+	Bypass
+	// Refresh sends the read to DynamoDB, replacing whatever was cached with the result.
+	Refresh
+)
+
+// decide consults the cache policy, if there is one, for a read.
+// op is the name of the DynamoDB operation, such as "GetItem".
+func (c *Cache) decide(ctx aws.Context, op, table string) Decision {
+	if c.policy == nil {
+		return Use
+	}
+	return c.policy(ctx, op, table)
+}
+
+type ttlKey struct{}
+
+// WithTTL returns a context that caches items read or written with it for d,
+// instead of the usual TTL (see WithItemTTL and WithNegativeTTL), such as to briefly cache
+// an item that's about to be overwritten. Items still expire no later than their TTL attribute
+// says, see WithItemTTLAttribute. A d of zero or less keeps the items out of the cache.
+// It applies to GetItem, BatchGetItem, PutItem, UpdateItem, DeleteItem, BatchWriteItem,
+// TransactWriteItems, WarmItems, and RefreshItem, but not to query or scan results.
+func WithTTL(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, ttlKey{}, d)
+}
+
+// ttlFrom returns the TTL set by WithTTL, if any.
+func ttlFrom(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(ttlKey{}).(time.Duration)
+	return d, ok
+}
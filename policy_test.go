@@ -0,0 +1,58 @@
+package localcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestWithTTL(t *testing.T) {
+	ctx := WithTTL(context.Background(), 50*time.Millisecond)
+	c, _ := newTestCache(t, WithItemTTL(time.Hour))
+	if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{TableName: aws.String("T"), Key: key("a", "2")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "3")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, sk := range []string{"1", "2"} {
+		if ttl, ok := c.ItemTTL("T", key("a", sk)); !ok || ttl > 50*time.Millisecond {
+			t.Errorf("ItemTTL(%s) = %v, %v; want at most 50ms", sk, ttl, ok)
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	for _, sk := range []string{"1", "2"} {
+		if _, ok := c.ItemTTL("T", key("a", sk)); ok {
+			t.Errorf("item %s still cached", sk)
+		}
+	}
+	if _, ok := c.ItemTTL("T", key("a", "3")); !ok {
+		t.Error("item written without a TTL expired too")
+	}
+}
+
+func TestWithTTLDontCache(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second} {
+		ctx := WithTTL(context.Background(), d)
+		c, f := newTestCache(t, WithItemTTL(time.Hour))
+		f.put("T", item("pk", "a", "sk", "1"))
+		getItem(t, c, key("a", "2"))
+		if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: key("a", "1")}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: aws.String("T"), Item: item("pk", "a", "sk", "2")}); err != nil {
+			t.Fatal(err)
+		}
+		// expired entries would still be stored
+		if n := c.items.ItemCount(); n != 0 {
+			t.Errorf("WithTTL(%v): %d items stored", d, n)
+		}
+	}
+}
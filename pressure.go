@@ -0,0 +1,64 @@
+package localcache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// pressureWatcher estimates how many items the item cache evicts
+// and reports when evictions happen faster than expected.
+//
+// Backends don't tell us about evictions, so they are inferred from
+// the item count: whatever went in and wasn't explicitly deleted,
+// but is no longer there, was evicted.
+type pressureWatcher struct {
+	interval  time.Duration
+	threshold int
+	fn        func(evicted int)
+
+	inserts atomic.Int64
+	deletes atomic.Int64
+}
+
+// watchPressure runs until the cache is closed. prev is the item count
+// as of when insert and delete tracking started.
+func (c *Cache) watchPressure(prev int64) {
+	pw := c.pressure
+	ticker := time.NewTicker(pw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		count := int64(c.items.ItemCount())
+		evicted := prev + pw.inserts.Swap(0) - pw.deletes.Swap(0) - count
+		prev = count
+		if evicted <= int64(pw.threshold) {
+			continue
+		}
+		c.log(LogEntry{Msg: "item cache pressure", Args: []interface{}{"evicted", evicted, "in", pw.interval}})
+		if pw.fn != nil {
+			pw.fn(int(evicted))
+		}
+	}
+}
+
+// trackInsert records a new item (not a replacement) being cached.
+func (c *Cache) trackInsert(table, key string) {
+	if c.pressure == nil {
+		return
+	}
+	if _, ok := peek(c.items, c.cacheKey(table), key); ok {
+		return
+	}
+	c.pressure.inserts.Add(1)
+}
+
+func (c *Cache) trackDelete(deleted bool) {
+	if c.pressure == nil || !deleted {
+		return
+	}
+	c.pressure.deletes.Add(1)
+}
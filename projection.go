@@ -0,0 +1,229 @@
+package localcache
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Projected items are partial, so they can't go in the item cache.
+// Instead they are layered under their item's key in the projection cache,
+// with the normalized projection as the secondary key.
+// Whenever the item cache entry for a key changes, its projections are dropped.
+// The projection cache can't enumerate a table's items, so when all of them are dropped
+// at once (see dropItems) the table's layers move to a new epoch instead,
+// and the old ones are left to expire.
+
+func isProjected(expr *string, attrs []*string) bool {
+	return expr != nil || len(attrs) > 0
+}
+
+var namePlaceholder = regexp.MustCompile(`#[A-Za-z0-9_]+`)
+
+// projectionKey normalizes a projection expression (or legacy AttributesToGet)
+// so that equivalent projections share a key: name placeholders are substituted
+// and the paths are sorted and deduplicated.
+func projectionKey(expr *string, attrs []*string, names map[string]*string) string {
+	var paths []string
+	if expr != nil {
+		for _, path := range strings.Split(*expr, ",") {
+			path = strings.TrimSpace(path)
+			path = namePlaceholder.ReplaceAllStringFunc(path, func(ph string) string {
+				if name, ok := names[ph]; ok && name != nil {
+					return *name
+				}
+				return ph
+			})
+			paths = append(paths, path)
+		}
+	}
+	for _, attr := range attrs {
+		paths = append(paths, aws.StringValue(attr))
+	}
+	sort.Strings(paths)
+	var key strings.Builder
+	for i, path := range paths {
+		if i > 0 && path == paths[i-1] {
+			continue
+		}
+		if key.Len() > 0 {
+			key.WriteByte(',')
+		}
+		key.WriteString(path)
+	}
+	return key.String()
+}
+
+// projectsKey reports whether the normalized projection proj includes every key attribute.
+func projectsKey(proj string, schema []*dynamodb.KeySchemaElement) bool {
+	paths := strings.Split(proj, ",")
+	for _, elem := range schema {
+		found := false
+		for _, path := range paths {
+			if path == aws.StringValue(elem.AttributeName) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// projectionLayer is the primary key of the projections of the item with key.
+func (c *Cache) projectionLayer(table, key string) string {
+	layer := c.cacheKey(key)
+	if v, ok := c.itemEpochs.Load(table); ok {
+		layer += "~" + strconv.FormatUint(v.(*atomic.Uint64).Load(), 10)
+	}
+	return layer
+}
+
+// dropItems drops every cached item of table, along with their projections.
+func (c *Cache) dropItems(table string) {
+	v, _ := c.itemEpochs.LoadOrStore(table, new(atomic.Uint64))
+	v.(*atomic.Uint64).Add(1)
+	c.items.DeleteAll(c.cacheKey(table))
+}
+
+func (c *Cache) getProjection(table, key, proj string) (interface{}, bool) {
+	item := c.projections.Get(c.projectionLayer(table, key), c.cacheKey(proj))
+	if item == nil || item.Expired() {
+		return nil, false
+	}
+	return item.Value(), true
+}
+
+func (c *Cache) storeProjection(ctx aws.Context, op, table, key, proj string, v interface{}) {
+	ttl, ok := c.ttlOf(ctx, v)
+	if !ok {
+		c.projections.Delete(c.projectionLayer(table, key), c.cacheKey(proj))
+		return
+	}
+	if v, ok = c.transform(table, v); !ok {
+		c.projections.Delete(c.projectionLayer(table, key), c.cacheKey(proj))
+		return
+	}
+	c.log(LogEntry{Op: op, Table: table, Key: key, Msg: "caching projection", TTL: ttl, Args: []interface{}{proj}})
+	c.projections.Set(c.projectionLayer(table, key), c.cacheKey(proj), v, ttl)
+	c.sizes.projections.add(key+proj, v)
+}
+
+func (c *Cache) deleteProjections(table, key string) {
+	c.projections.DeleteAll(c.projectionLayer(table, key))
+}
+
+func (c *Cache) getProjectedItem(ctx aws.Context, input *dynamodb.GetItemInput, key, proj string, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	item, ok := c.getProjection(*input.TableName, key, proj)
+	if !ok && c.localProjection {
+		if full, found := c.getItem(*input.TableName, key); found {
+			if full == none || c.softDeleted(full) {
+				item, ok = none, true
+			} else if projected, can := projectItem(full.(map[string]*dynamodb.AttributeValue), input.ProjectionExpression, input.AttributesToGet, input.ExpressionAttributeNames); can {
+				c.log(LogEntry{Op: "GetItem", Table: *input.TableName, Key: key, Msg: "locally projected item", Args: []interface{}{proj}})
+				item, ok = projected, true
+			}
+		}
+	}
+	if c.lookup(ctx, ok, LogEntry{Op: "GetItem", Table: *input.TableName, Key: key, Args: []interface{}{proj}}) {
+		if item == none || c.softDeleted(item) {
+			return emptyGet, nil
+		}
+		return &dynamodb.GetItemOutput{
+			Item: item.(map[string]*dynamodb.AttributeValue),
+		}, nil
+	}
+	gen := c.itemGen(*input.TableName, key)
+	start := time.Now()
+	out, err := c.DynamoDB.GetItemWithContext(ctx, input, opts...)
+	c.timeBackend(start)
+	if err != nil {
+		c.recordError(*input.TableName, err)
+		if stale, ok := c.staleGet(*input.TableName, key, proj, err); ok {
+			return stale, nil
+		}
+		return out, err
+	}
+	switch {
+	case ok:
+		// in a dry run, ok means the lookup would have hit, so the cached projection stays as it was
+	case !c.admit("GetItem", *input.TableName, key):
+	case out.Item == nil:
+		c.fillProjection(ctx, "GetItem", *input.TableName, key, proj, none, gen)
+	default:
+		c.fillProjection(ctx, "GetItem", *input.TableName, key, proj, out.Item, gen)
+	}
+	if c.softDeleted(out.Item) {
+		return &dynamodb.GetItemOutput{ConsumedCapacity: out.ConsumedCapacity}, err
+	}
+	return out, err
+}
+
+// projectItem applies a projection to a full item, for WithLocalProjection.
+// Only paths made of attribute names are supported: it returns false if any
+// path indexes into a list, leaving it to DynamoDB.
+func projectItem(item map[string]*dynamodb.AttributeValue, expr *string, attrs []*string, names map[string]*string) (map[string]*dynamodb.AttributeValue, bool) {
+	var paths [][]string
+	if expr != nil {
+		for _, path := range strings.Split(*expr, ",") {
+			parts := strings.Split(strings.TrimSpace(path), ".")
+			for i, part := range parts {
+				if strings.ContainsAny(part, "[]") {
+					return nil, false
+				}
+				// substituted names are taken literally, dots and all
+				if strings.HasPrefix(part, "#") {
+					name, ok := names[part]
+					if !ok || name == nil {
+						return nil, false
+					}
+					parts[i] = *name
+				}
+			}
+			paths = append(paths, parts)
+		}
+	}
+	for _, attr := range attrs {
+		paths = append(paths, []string{aws.StringValue(attr)})
+	}
+
+	projected := make(map[string]*dynamodb.AttributeValue)
+	for _, path := range paths {
+		projectPath(projected, item, path)
+	}
+	return projected, true
+}
+
+// projectPath copies the value at path in src into dst, creating maps along the way as needed.
+func projectPath(dst, src map[string]*dynamodb.AttributeValue, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	if v.M == nil {
+		return
+	}
+	child := dst[path[0]]
+	switch {
+	case child == nil:
+		child = &dynamodb.AttributeValue{M: make(map[string]*dynamodb.AttributeValue)}
+		dst[path[0]] = child
+	case child == v:
+		// already copied whole by an overlapping path
+		return
+	}
+	projectPath(child.M, v.M, path[1:])
+}
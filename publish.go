@@ -0,0 +1,75 @@
+package localcache
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// invalidationPublisher is set by WithInvalidationPublisher.
+type invalidationPublisher struct {
+	fn   func(table string, key map[string]*dynamodb.AttributeValue)
+	sync bool
+}
+
+type publishedKey struct {
+	table string
+	key   map[string]*dynamodb.AttributeValue
+}
+
+// keyOf returns just the key attributes of item.
+func keyOf(item map[string]*dynamodb.AttributeValue, schema []*dynamodb.KeySchemaElement) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue, len(schema))
+	for _, elem := range schema {
+		if av, ok := item[*elem.AttributeName]; ok {
+			key[*elem.AttributeName] = av
+		}
+	}
+	return key
+}
+
+// publish tells the invalidation publisher about an item invalidated by a write.
+// The write already went through, so a panicking publisher is reported with handleError
+// instead of failing it.
+func (c *Cache) publish(table string, key map[string]*dynamodb.AttributeValue) {
+	pub := c.publisher
+	call := func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.handleError(fmt.Errorf("localcache: invalidation publisher panicked: %v", r))
+			}
+		}()
+		pub.fn(table, key)
+	}
+	if pub.sync {
+		call()
+		return
+	}
+	c.background(call)
+}
+
+// InvalidateItem drops the given item from the cache, along with the cached queries and
+// scans it could be part of. It is meant for applying invalidations published by other
+// instances (see WithInvalidationPublisher), so it doesn't publish them again.
+//
+// Only the key is needed, but index partitions are only known for items this cache holds:
+// query results from indexes are otherwise left to expire.
+func (c *Cache) InvalidateItem(table string, key map[string]*dynamodb.AttributeValue) error {
+	schema, err := c.schemaOf(aws.BackgroundContext(), table)
+	if err != nil {
+		return err
+	}
+	ik := itemKey(table, key, schema)
+
+	inv := c.newInvalidation(aws.BackgroundContext())
+	inv.keys = nil
+	inv.add(table, key)
+	if old, ok := c.peekItem(table, ik); ok && old != none {
+		inv.add(table, old.(map[string]*dynamodb.AttributeValue))
+	}
+	c.log(LogEntry{Op: "InvalidateItem", Table: table, Key: ik, Msg: "invalidate item"})
+	c.deleteItem(table, ik)
+	inv.run()
+	return nil
+}
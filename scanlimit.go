@@ -0,0 +1,119 @@
+package localcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// scanLimit keeps track of the scans cached in each scan layer, least recently used last,
+// so that layers can be held to a number of entries. See WithMaxScansPerTable.
+// A nil *scanLimit doesn't track anything.
+//
+// It only knows what the cache put in and took out: entries that ccache evicts or lets expire
+// are still counted until they're pushed out of the list, so a layer may hold fewer than max.
+type scanLimit struct {
+	mu     sync.Mutex
+	max    int
+	layers map[string]*scanList
+}
+
+type scanList struct {
+	order *list.List // of keys, most recently used first
+	elems map[string]*list.Element
+}
+
+func newScanLimit(max int) *scanLimit {
+	return &scanLimit{
+		max:    max,
+		layers: make(map[string]*scanList),
+	}
+}
+
+// touch marks key as the most recently used scan in layer, adding it if it's new,
+// and returns the keys that no longer fit.
+func (sl *scanLimit) touch(layer, key string) (evicted []string) {
+	if sl == nil {
+		return nil
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	l := sl.layers[layer]
+	if l == nil {
+		l = &scanList{order: list.New(), elems: make(map[string]*list.Element)}
+		sl.layers[layer] = l
+	}
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.elems[key] = l.order.PushFront(key)
+	for l.order.Len() > sl.max {
+		e := l.order.Back()
+		old := l.order.Remove(e).(string)
+		delete(l.elems, old)
+		evicted = append(evicted, old)
+	}
+	return evicted
+}
+
+// hit marks key as recently used, if it's tracked.
+func (sl *scanLimit) hit(layer, key string) {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if l := sl.layers[layer]; l != nil {
+		if e, ok := l.elems[key]; ok {
+			l.order.MoveToFront(e)
+		}
+	}
+}
+
+func (sl *scanLimit) remove(layer, key string) {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if l := sl.layers[layer]; l != nil {
+		if e, ok := l.elems[key]; ok {
+			l.order.Remove(e)
+			delete(l.elems, key)
+		}
+	}
+}
+
+// forget stops tracking layer, after its scans were all dropped.
+func (sl *scanLimit) forget(layer string) {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	delete(sl.layers, layer)
+}
+
+func (sl *scanLimit) clear() {
+	if sl == nil {
+		return
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.layers = make(map[string]*scanList)
+}
+
+// trackScan records that key was just cached in the scan layer, evicting
+// the layer's least recently used scans beyond WithMaxScansPerTable.
+func (c *Cache) trackScan(layer, key string) {
+	for _, old := range c.scanLimit.touch(layer, key) {
+		c.log(LogEntry{Table: layer, Key: old, Msg: "evicting scan over limit"})
+		c.scans.Delete(c.cacheKey(layer), c.cacheKey(old))
+	}
+}
+
+// dropScans deletes every cached scan in layer.
+func (c *Cache) dropScans(layer string) {
+	c.scans.DeleteAll(c.cacheKey(layer))
+	c.scanLimit.forget(layer)
+}
@@ -0,0 +1,76 @@
+package localcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// registeredTTL is how long registered descriptions are cached: practically forever,
+// since the point is to never describe the table.
+const registeredTTL = 100 * 365 * 24 * time.Hour
+
+// RegisterSchema sets table's description, instead of describing it with DynamoDB.
+// Only the key schemas of the table and its indexes are needed. This lets tests and
+// offline environments use the cache without DescribeTable permissions or any AWS calls.
+// Registered descriptions don't expire, but are dropped along with the rest of the
+// description cache, such as by PurgeAll. Querying an index missing from the description
+// makes the cache describe the table after all, in case the index is new.
+func (c *Cache) RegisterSchema(table string, desc *dynamodb.DescribeTableOutput) error {
+	if err := validateDesc(table, desc); err != nil {
+		return err
+	}
+	if name := aws.StringValue(desc.Table.TableName); name != "" && name != table {
+		return fmt.Errorf("localcache: register %s: description is of table %s", table, name)
+	}
+	normalizeKeySchemas(desc)
+	c.tableDesc.set(c.region(), table, desc, registeredTTL)
+	return nil
+}
+
+// LoadSchemaJSON registers table's description from JSON, as output by
+// `aws dynamodb describe-table`. See RegisterSchema.
+func (c *Cache) LoadSchemaJSON(table string, r io.Reader) error {
+	// only the key schemas are decoded, so the rest (such as timestamps,
+	// which the CLI formats differently from the SDK) doesn't matter
+	var raw struct {
+		Table struct {
+			TableName              *string
+			KeySchema              []*dynamodb.KeySchemaElement
+			GlobalSecondaryIndexes []struct {
+				IndexName *string
+				KeySchema []*dynamodb.KeySchemaElement
+			}
+			LocalSecondaryIndexes []struct {
+				IndexName *string
+				KeySchema []*dynamodb.KeySchemaElement
+			}
+		}
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return fmt.Errorf("localcache: load schema of %s: %w", table, err)
+	}
+	desc := &dynamodb.DescribeTableOutput{
+		Table: &dynamodb.TableDescription{
+			TableName: raw.Table.TableName,
+			KeySchema: raw.Table.KeySchema,
+		},
+	}
+	for _, gsi := range raw.Table.GlobalSecondaryIndexes {
+		desc.Table.GlobalSecondaryIndexes = append(desc.Table.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName: gsi.IndexName,
+			KeySchema: gsi.KeySchema,
+		})
+	}
+	for _, lsi := range raw.Table.LocalSecondaryIndexes {
+		desc.Table.LocalSecondaryIndexes = append(desc.Table.LocalSecondaryIndexes, &dynamodb.LocalSecondaryIndexDescription{
+			IndexName: lsi.IndexName,
+			KeySchema: lsi.KeySchema,
+		})
+	}
+	return c.RegisterSchema(table, desc)
+}
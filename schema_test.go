@@ -0,0 +1,75 @@
+package localcache
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// describeTableJSON is as output by `aws dynamodb describe-table`, which formats timestamps
+// as strings rather than the epoch seconds the SDK expects.
+const describeTableJSON = `{
+    "Table": {
+        "AttributeDefinitions": [
+            {"AttributeName": "pk", "AttributeType": "S"},
+            {"AttributeName": "sk", "AttributeType": "S"},
+            {"AttributeName": "g", "AttributeType": "S"}
+        ],
+        "TableName": "T",
+        "KeySchema": [
+            {"AttributeName": "sk", "KeyType": "RANGE"},
+            {"AttributeName": "pk", "KeyType": "HASH"}
+        ],
+        "TableStatus": "ACTIVE",
+        "CreationDateTime": "2024-03-01T12:34:56.789000+09:00",
+        "ProvisionedThroughput": {
+            "NumberOfDecreasesToday": 0,
+            "ReadCapacityUnits": 0,
+            "WriteCapacityUnits": 0
+        },
+        "TableSizeBytes": 0,
+        "ItemCount": 0,
+        "TableArn": "arn:aws:dynamodb:us-east-1:123456789012:table/T",
+        "BillingModeSummary": {
+            "BillingMode": "PAY_PER_REQUEST",
+            "LastUpdateToPayPerRequestDateTime": "2024-03-01T12:34:56.789000+09:00"
+        },
+        "GlobalSecondaryIndexes": [
+            {
+                "IndexName": "gsi",
+                "KeySchema": [
+                    {"AttributeName": "g", "KeyType": "HASH"},
+                    {"AttributeName": "sk", "KeyType": "RANGE"}
+                ],
+                "Projection": {"ProjectionType": "ALL"},
+                "IndexStatus": "ACTIVE"
+            }
+        ]
+    }
+}`
+
+func TestLoadSchemaJSON(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	if err := c.LoadSchemaJSON("T", strings.NewReader(describeTableJSON)); err != nil {
+		t.Fatal(err)
+	}
+	f.put("T", item("pk", "a", "sk", "1", "g", "x"))
+
+	for i := 0; i < 2; i++ {
+		getItem(t, c, key("a", "1"))
+		if _, err := c.QueryWithContext(ctx, indexQuery("gsi", "x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.count("DescribeTable"); got != 0 {
+		t.Errorf("described the table %d times", got)
+	}
+	if f.count("GetItem") != 1 || f.count("Query") != 1 {
+		t.Errorf("got %d times and queried %d times, want once each", f.count("GetItem"), f.count("Query"))
+	}
+
+	if err := c.LoadSchemaJSON("T", strings.NewReader("{")); err == nil {
+		t.Error("loaded truncated JSON")
+	}
+}
@@ -0,0 +1,112 @@
+package localcache
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/karlseguin/ccache"
+)
+
+// sharded is a Backend spread over several others, see WithShards.
+// Most backends are sharded by primary key, which keeps each group of entries together,
+// so DeleteAll only has to go to one shard. The items and GSI items backends group their
+// entries by table (or index), which would put each table in a single shard, so they are
+// sharded by secondary key instead and DeleteAll goes to every shard.
+type sharded struct {
+	shards  []Backend
+	sharder func(key string) int
+	// bySecondary shards by secondary key
+	bySecondary bool
+}
+
+// hashShard is the default sharder.
+func hashShard(n int) func(key string) int {
+	return func(key string) int {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32() % uint32(n))
+	}
+}
+
+func (s *sharded) shard(primary, secondary string) Backend {
+	key := primary
+	if s.bySecondary {
+		key = secondary
+	}
+	i := s.sharder(key) % len(s.shards)
+	if i < 0 {
+		i += len(s.shards)
+	}
+	return s.shards[i]
+}
+
+func (s *sharded) Get(primary, secondary string) Entry {
+	return s.shard(primary, secondary).Get(primary, secondary)
+}
+
+func (s *sharded) Peek(primary, secondary string) Entry {
+	return s.shard(primary, secondary).Peek(primary, secondary)
+}
+
+func (s *sharded) Set(primary, secondary string, value interface{}, ttl time.Duration) {
+	s.shard(primary, secondary).Set(primary, secondary, value, ttl)
+}
+
+func (s *sharded) Delete(primary, secondary string) bool {
+	return s.shard(primary, secondary).Delete(primary, secondary)
+}
+
+func (s *sharded) DeleteAll(primary string) bool {
+	if !s.bySecondary {
+		return s.shard(primary, "").DeleteAll(primary)
+	}
+	deleted := false
+	for _, shard := range s.shards {
+		if shard.DeleteAll(primary) {
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+func (s *sharded) ItemCount() int {
+	n := 0
+	for _, shard := range s.shards {
+		n += shard.ItemCount()
+	}
+	return n
+}
+
+func (s *sharded) Clear() {
+	for _, shard := range s.shards {
+		shard.Clear()
+	}
+}
+
+func (s *sharded) Stop() {
+	for _, shard := range s.shards {
+		shard.Stop()
+	}
+}
+
+// newShardedBackend creates the named backend out of c.shards shards.
+func (c *Cache) newShardedBackend(name string, cfg *ccache.Configuration) Backend {
+	shards := make([]Backend, c.shards)
+	for i := range shards {
+		if c.newShardFn != nil {
+			shards[i] = c.newShardFn(name, i)
+		}
+		if shards[i] == nil {
+			shards[i] = c.newUnshardedBackend(name, cfg)
+		}
+	}
+	sharder := c.sharder
+	if sharder == nil {
+		sharder = hashShard(len(shards))
+	}
+	return &sharded{
+		shards:      shards,
+		sharder:     sharder,
+		bySecondary: name == BackendItems || name == BackendGSIItems,
+	}
+}
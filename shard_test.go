@@ -0,0 +1,45 @@
+package localcache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestShardedItems(t *testing.T) {
+	ctx := context.Background()
+	shards := make(map[string][]Backend)
+	c, f := newTestCache(t, WithShards(4, func(name string, shard int) Backend {
+		b := newCCacheBackend(nil)
+		shards[name] = append(shards[name], b)
+		return b
+	}))
+	f.on("ExecuteStatement", func([]byte) (interface{}, error) {
+		return &dynamodb.ExecuteStatementOutput{}, nil
+	})
+	for i := 0; i < 40; i++ {
+		getItem(t, c, key("a", strconv.Itoa(i)))
+	}
+	used := 0
+	for _, b := range shards[BackendItems] {
+		if b.ItemCount() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("a table's items went to %d of 4 shards", used)
+	}
+
+	_, err := c.ExecuteStatementWithContext(ctx, &dynamodb.ExecuteStatementInput{Statement: aws.String(`DELETE FROM "T" WHERE pk = 'a' AND sk = '1'`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range shards[BackendItems] {
+		if n := b.ItemCount(); n != 0 {
+			t.Errorf("shard %d still holds %d items of the table", i, n)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package localcache
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// cacheSizes tracks the average size of each backend's entries, for SizeBytes.
+type cacheSizes struct {
+	items       avgSize
+	projections avgSize
+	queries     avgSize
+	scans       avgSize
+	gsiItems    avgSize
+}
+
+// avgSize is the running average size of the entries put in a backend.
+type avgSize struct {
+	bytes atomic.Int64
+	n     atomic.Int64
+}
+
+func (a *avgSize) add(key string, v interface{}) {
+	a.bytes.Add(int64(len(key) + entrySize(v)))
+	a.n.Add(1)
+}
+
+// estimate returns the size of count entries of average size.
+func (a *avgSize) estimate(count int) int64 {
+	n := a.n.Load()
+	if n == 0 {
+		return 0
+	}
+	return a.bytes.Load() / n * int64(count)
+}
+
+// SizeBytes estimates how much data the cache holds, in bytes: the number of entries
+// in each of its caches times their average size, as measured when they were cached.
+// It is meant for capacity planning, not accounting: it counts items the way DynamoDB
+// does (see WithMaxCachedItemBytes) rather than their actual memory use, which is
+// several times larger, and it doesn't include table descriptions.
+func (c *Cache) SizeBytes() int64 {
+	total := c.sizes.items.estimate(c.items.ItemCount()) +
+		c.sizes.projections.estimate(c.projections.ItemCount()) +
+		c.sizes.queries.estimate(c.queries.ItemCount()) +
+		c.sizes.scans.estimate(c.scans.ItemCount())
+	if c.gsiItems != nil {
+		total += c.sizes.gsiItems.estimate(c.gsiItems.ItemCount())
+	}
+	return total
+}
+
+// entrySize estimates the size of a cached value.
+func entrySize(v interface{}) int {
+	switch v := v.(type) {
+	case map[string]*dynamodb.AttributeValue:
+		return itemSize(v)
+	case *dynamodb.QueryOutput:
+		return itemsSize(v.Items) + itemSize(v.LastEvaluatedKey)
+	case *dynamodb.ScanOutput:
+		return itemsSize(v.Items) + itemSize(v.LastEvaluatedKey)
+	case *dynamodb.ExecuteStatementOutput:
+		n := itemsSize(v.Items)
+		if v.NextToken != nil {
+			n += len(*v.NextToken)
+		}
+		return n
+	}
+	return 0
+}
+
+func itemsSize(items []map[string]*dynamodb.AttributeValue) int {
+	n := 0
+	for _, item := range items {
+		n += itemSize(item)
+	}
+	return n
+}
+
+// itemSize estimates the size of item the way DynamoDB counts it towards the 400KB limit:
+// attribute names plus values, where numbers take about one byte per two digits
+// and lists and maps take a few bytes of overhead per element.
+func itemSize(item map[string]*dynamodb.AttributeValue) int {
+	n := 0
+	for name, av := range item {
+		n += len(name) + avSize(av)
+	}
+	return n
+}
+
+func avSize(av *dynamodb.AttributeValue) int {
+	if av == nil {
+		return 0
+	}
+	switch {
+	case av.S != nil:
+		return len(*av.S)
+	case av.N != nil:
+		return numberSize(*av.N)
+	case av.B != nil:
+		return len(av.B)
+	case av.BOOL != nil, av.NULL != nil:
+		return 1
+	case av.SS != nil:
+		n := 0
+		for _, s := range av.SS {
+			if s != nil {
+				n += len(*s)
+			}
+		}
+		return n
+	case av.NS != nil:
+		n := 0
+		for _, s := range av.NS {
+			if s != nil {
+				n += numberSize(*s)
+			}
+		}
+		return n
+	case av.BS != nil:
+		n := 0
+		for _, b := range av.BS {
+			n += len(b)
+		}
+		return n
+	case av.L != nil:
+		n := 3
+		for _, v := range av.L {
+			n += 1 + avSize(v)
+		}
+		return n
+	case av.M != nil:
+		n := 3
+		for k, v := range av.M {
+			n += 1 + len(k) + avSize(v)
+		}
+		return n
+	}
+	return 0
+}
+
+func numberSize(n string) int {
+	digits := len(strings.TrimLeft(strings.TrimPrefix(n, "-"), "0."))
+	return (digits+1)/2 + 1
+}
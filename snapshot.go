@@ -0,0 +1,69 @@
+package localcache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type snapshotKey struct{}
+
+// snapshot memoizes GetItem results for the life of a request.
+type snapshot struct {
+	mu sync.Mutex
+	// item key → projection ("" for the full item) → result
+	items map[string]map[string]*dynamodb.GetItemOutput
+}
+
+// Snapshot returns a context that pins GetItem results: within it, the first read of
+// an item is remembered and returned by later reads of the same item, regardless
+// of invalidation or expiry in the cache. Use it to get a consistent view
+// of items read multiple times while handling a request.
+// Writes made through the cache with the snapshot context are seen by later reads.
+func Snapshot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, snapshotKey{}, &snapshot{
+		items: make(map[string]map[string]*dynamodb.GetItemOutput),
+	})
+}
+
+// snapshotFrom returns ctx's snapshot, or nil if it doesn't have one.
+// All snapshot methods are no-ops on a nil snapshot.
+func snapshotFrom(ctx context.Context) *snapshot {
+	snap, _ := ctx.Value(snapshotKey{}).(*snapshot)
+	return snap
+}
+
+func (snap *snapshot) get(key, proj string) (*dynamodb.GetItemOutput, bool) {
+	if snap == nil {
+		return nil, false
+	}
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	out, ok := snap.items[key][proj]
+	return out, ok
+}
+
+func (snap *snapshot) set(key, proj string, out *dynamodb.GetItemOutput) {
+	if snap == nil {
+		return
+	}
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	projs := snap.items[key]
+	if projs == nil {
+		projs = make(map[string]*dynamodb.GetItemOutput)
+		snap.items[key] = projs
+	}
+	projs[proj] = out
+}
+
+// forget drops every pinned read of the given item, for after it's written.
+func (snap *snapshot) forget(key string) {
+	if snap == nil {
+		return
+	}
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	delete(snap.items, key)
+}
@@ -0,0 +1,52 @@
+package localcache
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// softDeleted reports whether v is an item marked deleted by the soft delete attribute,
+// see WithSoftDeleteAttribute. The mark is truthy if it's true, a nonzero number,
+// or a non-empty string, so deletion flags and timestamps both work.
+func (c *Cache) softDeleted(v interface{}) bool {
+	if c.softDeleteAttr == "" {
+		return false
+	}
+	item, ok := v.(map[string]*dynamodb.AttributeValue)
+	if !ok {
+		return false
+	}
+	av := item[c.softDeleteAttr]
+	switch {
+	case av == nil:
+		return false
+	case av.BOOL != nil:
+		return *av.BOOL
+	case av.N != nil:
+		n, err := strconv.ParseFloat(*av.N, 64)
+		return err != nil || n != 0
+	case av.S != nil:
+		return *av.S != ""
+	}
+	return false
+}
+
+// withoutSoftDeleted drops soft deleted items from the responses of cached tables.
+func (c *Cache) withoutSoftDeleted(out *dynamodb.BatchGetItemOutput, uncached map[string]bool) {
+	if c.softDeleteAttr == "" {
+		return
+	}
+	for table, resp := range out.Responses {
+		if uncached[table] {
+			continue
+		}
+		kept := resp[:0]
+		for _, item := range resp {
+			if !c.softDeleted(item) {
+				kept = append(kept, item)
+			}
+		}
+		out.Responses[table] = kept
+	}
+}
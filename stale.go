@@ -0,0 +1,56 @@
+package localcache
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// defaultStaleGrace is how long expired items can be served, unless set by WithStaleGrace.
+const defaultStaleGrace = time.Hour
+
+// stale returns an expired entry that is still within the stale grace period,
+// for serving when DynamoDB fails. See WithServeStaleOnError.
+// Entries that were invalidated are gone rather than expired, so they are never served.
+func (c *Cache) stale(b Backend, primary, secondary string) (interface{}, bool) {
+	if !c.serveStale {
+		return nil, false
+	}
+	entry := b.Peek(primary, secondary)
+	if entry == nil || !entry.Expired() || -entry.TTL() > c.staleGrace {
+		return nil, false
+	}
+	v := entry.Value()
+	// the item itself may have expired in the meantime
+	if _, ok := c.ttlOf(aws.BackgroundContext(), v); !ok {
+		return nil, false
+	}
+	c.incStale()
+	return v, true
+}
+
+// staleGet serves the stale version of an item (or projection of one) after a failed GetItem.
+func (c *Cache) staleGet(table, key, proj string, err error) (*dynamodb.GetItemOutput, bool) {
+	var v interface{}
+	var ok bool
+	if proj == "" {
+		v, ok = c.stale(c.items, c.cacheKey(table), c.cacheKey(key))
+	} else {
+		v, ok = c.stale(c.projections, c.projectionLayer(table, key), c.cacheKey(proj))
+	}
+	if !ok {
+		return nil, false
+	}
+	c.log(LogEntry{Op: "GetItem", Table: table, Key: key, Msg: "serving stale after error", Args: []interface{}{err}})
+	if v == none || c.softDeleted(v) {
+		return emptyGet, true
+	}
+	return &dynamodb.GetItemOutput{
+		Item: v.(map[string]*dynamodb.AttributeValue),
+	}, true
+}
+
+func (c *Cache) incStale() {
+	c.stats.update(func(s *Stats) { s.StaleServed++ })
+}
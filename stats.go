@@ -0,0 +1,110 @@
+package localcache
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats are cumulative counters of the cache's activity, see Cache.Stats.
+type Stats struct {
+	// HitCount is the number of reads served from the cache.
+	// Each key of a BatchGetItem counts separately.
+	HitCount uint64
+	// MissCount is the number of cacheable reads that had to go to DynamoDB.
+	// Each key of a BatchGetItem counts separately.
+	MissCount uint64
+	// BackendCalls is the number of DynamoDB calls made to serve misses.
+	BackendCalls uint64
+	// BackendLatencyTotal is the total time spent in those calls.
+	// Divided by BackendCalls, it estimates the latency saved by each hit.
+	BackendLatencyTotal time.Duration
+	// Degradations is the number of reads that went straight to DynamoDB
+	// because the cache couldn't handle them, such as when describing the table failed.
+	// The reads themselves may well have succeeded, so a rising count points to
+	// a problem (such as missing DescribeTable permissions) that is otherwise silent.
+	Degradations uint64
+	// StaleServed is the number of reads answered with an expired entry because DynamoDB
+	// returned an error, see WithServeStaleOnError. They aren't counted as hits.
+	StaleServed uint64
+	// KeyBuilds is the number of cache keys built for reads, and KeyBuildTime the total time
+	// spent building them. They are only counted with WithKeyTiming.
+	KeyBuilds    uint64
+	KeyBuildTime time.Duration
+}
+
+// counters holds a cache's Stats, which are updated and read together
+// so that every snapshot is consistent.
+type counters struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (cs *counters) update(fn func(*Stats)) {
+	cs.mu.Lock()
+	fn(&cs.stats)
+	cs.mu.Unlock()
+}
+
+func (cs *counters) snapshot() Stats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.stats
+}
+
+// Stats returns the cache's counters since it was created.
+// They're a consistent snapshot: a read's miss is always counted before its
+// BackendCalls, and latencies are counted along with their calls.
+func (c *Cache) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// reportStats calls the stats handler with the cache's stats every interval,
+// until the cache is closed. See WithStatsInterval.
+func (c *Cache) reportStats() {
+	ticker := time.NewTicker(c.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.statsFn(c.Stats())
+	}
+}
+
+// timeBackend records a DynamoDB call made to serve a miss, which started at start.
+func (c *Cache) timeBackend(start time.Time) {
+	elapsed := time.Since(start)
+	c.stats.update(func(s *Stats) {
+		s.BackendCalls++
+		s.BackendLatencyTotal += elapsed
+	})
+}
+
+// keyStart returns when building a read's cache key started,
+// or the zero time if key building isn't timed (see WithKeyTiming).
+func (c *Cache) keyStart() time.Time {
+	if !c.keyTiming {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// timeKey records a cache key built since start, if it's timed.
+func (c *Cache) timeKey(start time.Time) {
+	if start.IsZero() {
+		return
+	}
+	elapsed := time.Since(start)
+	c.stats.update(func(s *Stats) {
+		s.KeyBuilds++
+		s.KeyBuildTime += elapsed
+	})
+}
+
+// degrade records a read falling back to DynamoDB because of err.
+func (c *Cache) degrade(err error) {
+	c.log(LogEntry{Msg: "falling back to DynamoDB", Args: []interface{}{err}})
+	c.stats.update(func(s *Stats) { s.Degradations++ })
+}
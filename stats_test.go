@@ -0,0 +1,70 @@
+package localcache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TestStatsConcurrent reads the stats while they're being counted,
+// checking that every snapshot is consistent. Run it with -race.
+func TestStatsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(t, WithKeyTiming())
+	const readers, reads = 8, 100
+
+	var wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < reads; i++ {
+				k := key(strconv.Itoa(r), strconv.Itoa(i%10))
+				if _, err := c.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String("T"), Key: k}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(r)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var last Stats
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		stats := c.Stats()
+		if stats.HitCount < last.HitCount || stats.MissCount < last.MissCount || stats.BackendCalls < last.BackendCalls {
+			t.Fatalf("stats went backwards: %+v after %+v", stats, last)
+		}
+		// each read builds its key before it's looked up, and is looked up before it calls DynamoDB
+		if lookups := stats.HitCount + stats.MissCount; lookups > stats.KeyBuilds || stats.BackendCalls > stats.MissCount {
+			t.Fatalf("inconsistent stats: %+v", stats)
+		}
+		if (stats.BackendCalls == 0) != (stats.BackendLatencyTotal == 0) {
+			t.Fatalf("backend calls counted apart from their latency: %+v", stats)
+		}
+		last = stats
+	}
+
+	stats := c.Stats()
+	if got := stats.HitCount + stats.MissCount; got != readers*reads || stats.KeyBuilds != got {
+		t.Errorf("counted %d reads and %d keys, want %d each", got, stats.KeyBuilds, readers*reads)
+	}
+	if stats.MissCount != readers*10 || stats.BackendCalls != stats.MissCount {
+		t.Errorf("got %d misses and %d backend calls, want %d each", stats.MissCount, stats.BackendCalls, readers*10)
+	}
+	if ratio, samples := c.HitStats(); samples != readers*reads || ratio != float64(stats.HitCount)/float64(samples) {
+		t.Errorf("HitStats() = %v, %d", ratio, samples)
+	}
+}
@@ -0,0 +1,38 @@
+package localcache
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// TraceHook receives each cache lookup along with the context of the request
+// it was made for, see WithTraceHook. It must be safe for concurrent use and
+// shouldn't block, since it is called inline.
+type TraceHook func(ctx aws.Context, lookup TraceLookup)
+
+// TraceLookup describes a cache lookup, see TraceHook.
+// A single request can make several, such as BatchGetItem looking up each key.
+type TraceLookup struct {
+	// Op is the operation being served, such as "GetItem".
+	Op string
+	// Table is the table involved. For scans of an index with WithIndexScopedScanCache,
+	// it also names the index.
+	Table string
+	// Key is the cache key looked up. It is only set when Debug is on,
+	// since keys can contain sensitive values.
+	Key string
+	// Hit reports whether the key was found. In dry run mode,
+	// hits are still sent to DynamoDB, see WithDryRun.
+	Hit bool
+}
+
+// trace passes a lookup to the trace hook, if there is one.
+func (c *Cache) trace(ctx aws.Context, found bool, e LogEntry) {
+	if c.traceHook == nil {
+		return
+	}
+	lookup := TraceLookup{Op: e.Op, Table: e.Table, Hit: found}
+	if c.Debug {
+		lookup.Key = e.Key
+	}
+	c.traceHook(ctx, lookup)
+}
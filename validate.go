@@ -0,0 +1,79 @@
+package localcache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ValidateQuery reports why input would go straight to DynamoDB instead of being cached,
+// or returns nil if it would be cached. It describes the table if necessary.
+// WithCachePolicy isn't consulted, since it depends on each request's context.
+func (c *Cache) ValidateQuery(input *dynamodb.QueryInput) error {
+	if err := c.validateTable(input.TableName); err != nil {
+		return err
+	}
+	table := *input.TableName
+	if input.IndexName != nil && !c.cachesIndex(table, *input.IndexName) {
+		return fmt.Errorf("localcache: table %s: queries of index %s aren't cached, see WithInvalidatedIndexes", table, *input.IndexName)
+	}
+	if aws.BoolValue(input.ConsistentRead) && input.IndexName != nil && c.isGSI(aws.BackgroundContext(), table, *input.IndexName) {
+		return fmt.Errorf("localcache: table %s: strongly consistent queries of global secondary index %s aren't supported by DynamoDB", table, *input.IndexName)
+	}
+	if _, _, _, err := c.queryKeys(aws.BackgroundContext(), input); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SameQueryKey reports whether a and b would share a cache entry, such as queries that
+// differ only in how their placeholders are named. It describes their tables if necessary,
+// and returns an error if either can't be cached.
+func (c *Cache) SameQueryKey(a, b *dynamodb.QueryInput) (bool, error) {
+	if a.TableName == nil || b.TableName == nil {
+		return false, errors.New("localcache: no table name")
+	}
+	_, pa, ka, err := c.queryKeys(aws.BackgroundContext(), a)
+	if err != nil {
+		return false, err
+	}
+	_, pb, kb, err := c.queryKeys(aws.BackgroundContext(), b)
+	if err != nil {
+		return false, err
+	}
+	return pa == pb && ka == kb, nil
+}
+
+// ValidateScan is ValidateQuery for scans.
+func (c *Cache) ValidateScan(input *dynamodb.ScanInput) error {
+	if err := c.validateTable(input.TableName); err != nil {
+		return err
+	}
+	table := *input.TableName
+	if c.skipLimitedFilterScans && input.Limit != nil && input.FilterExpression != nil {
+		return fmt.Errorf("localcache: table %s: scans with both Limit and FilterExpression aren't cached, see WithoutLimitedFilterScans", table)
+	}
+	if aws.BoolValue(input.ConsistentRead) {
+		return fmt.Errorf("localcache: table %s: strongly consistent scans aren't cached", table)
+	}
+	if _, err := c.schemaOf(aws.BackgroundContext(), table); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateTable checks that reads of table can be cached at all.
+func (c *Cache) validateTable(table *string) error {
+	if !c.Enabled() {
+		return errors.New("localcache: cache is disabled")
+	}
+	if table == nil {
+		return errors.New("localcache: no table name")
+	}
+	if !c.isAllowed(*table) {
+		return fmt.Errorf("localcache: table %s isn't cached, see Allow and WithDenyList", *table)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package localcache
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// batchGetLimit is the maximum number of keys BatchGetItem accepts per request.
+const batchGetLimit = 100
+
+// Warmup describes the given tables ahead of time, so the first requests against them
+// don't have to wait on DescribeTable. It describes every table even if some fail,
+// returning their errors joined together.
+func (c *Cache) Warmup(ctx aws.Context, tables ...string) error {
+	var errs []error
+	for _, table := range tables {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if _, err := c.desc(ctx, table); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WarmItems fetches the given items from table and caches them,
+// caching keys that don't exist as empty. Use this to seed the cache with a
+// known hot set before traffic arrives. It does nothing while caching is disabled,
+// or if table isn't cached (see Allow and WithDenyList).
+func (c *Cache) WarmItems(ctx aws.Context, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	if !c.Enabled() || !c.isAllowed(table) {
+		return nil
+	}
+	schema, err := c.schemaOf(ctx, table)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), batchGetLimit)
+		chunk := keys[:n]
+		keys = keys[n:]
+
+		input := &dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				table: {Keys: chunk},
+			},
+		}
+		found := make(map[string]struct{}, len(chunk))
+		gens := make(map[string]generation, len(chunk))
+		for _, k := range chunk {
+			key := itemKey(table, k, schema)
+			gens[key] = c.itemGen(table, key)
+		}
+		err := c.DynamoDB.BatchGetItemPagesWithContext(ctx, input, func(out *dynamodb.BatchGetItemOutput, _ bool) bool {
+			for _, item := range out.Responses[table] {
+				key := itemKey(table, item, schema)
+				c.fillItem(ctx, opWarmItems, table, key, item, gens[key])
+				found[key] = struct{}{}
+			}
+			return true
+		})
+		if err != nil {
+			c.recordError(table, err)
+			return err
+		}
+		for _, k := range chunk {
+			key := itemKey(table, k, schema)
+			if _, ok := found[key]; ok {
+				continue
+			}
+			c.fillItem(ctx, opWarmItems, table, key, none, gens[key])
+		}
+	}
+	return nil
+}
+
+// RefreshItem reads the given item from table with a strongly consistent read,
+// overwrites its cached value with the result (caching it as empty if it doesn't exist),
+// and returns it. It always calls DynamoDB, so it can be used to correct the cache and get
+// the truth in one call. If the item differs from what was cached, the query partitions
+// holding either version are invalidated as well.
+func (c *Cache) RefreshItem(ctx aws.Context, table string, key map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, error) {
+	input := &dynamodb.GetItemInput{
+		TableName:      &table,
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	}
+	if !c.Enabled() || !c.isAllowed(table) {
+		out, err := c.DynamoDB.GetItemWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		return out.Item, nil
+	}
+
+	schema, err := c.schemaOf(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	ik := itemKey(table, key, schema)
+
+	gen := c.itemGen(table, ik)
+	out, err := c.DynamoDB.GetItemWithContext(ctx, input)
+	if err != nil {
+		c.recordError(table, err)
+		return nil, err
+	}
+
+	old, cached := c.peekItem(table, ik)
+	var fresh interface{} = none
+	if out.Item != nil {
+		fresh = out.Item
+	}
+	c.fillItem(ctx, opRefreshItem, table, ik, fresh, gen)
+	snapshotFrom(ctx).forget(ik)
+
+	if !cached || !reflect.DeepEqual(old, fresh) {
+		inv := c.newInvalidation(ctx)
+		// nothing was written, so there's nothing to publish
+		inv.keys = nil
+		if item, ok := old.(map[string]*dynamodb.AttributeValue); ok {
+			inv.add(table, item)
+		}
+		if out.Item != nil {
+			inv.add(table, out.Item)
+		}
+		inv.run()
+	}
+	return out.Item, nil
+}
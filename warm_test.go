@@ -0,0 +1,43 @@
+package localcache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestWarmItems(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1"))
+	keys := []map[string]*dynamodb.AttributeValue{key("a", "1"), key("b", "1")}
+
+	c.Deny("T")
+	if err := c.WarmItems(ctx, "T", keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("BatchGetItem"); got != 0 {
+		t.Fatalf("denied table warmed with %d BatchGetItem calls", got)
+	}
+
+	c, f = newTestCache(t)
+	f.put("T", item("pk", "a", "sk", "1"))
+	c.SetEnabled(false)
+	if err := c.WarmItems(ctx, "T", keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.count("BatchGetItem"); got != 0 {
+		t.Fatalf("disabled cache warmed with %d BatchGetItem calls", got)
+	}
+
+	c.SetEnabled(true)
+	if err := c.WarmItems(ctx, "T", keys); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if _, ok := c.ItemTTL("T", k); !ok {
+			t.Errorf("%v not warmed", k)
+		}
+	}
+}